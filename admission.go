@@ -0,0 +1,241 @@
+package hail
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// admission 限制同時連線的Session數量 (caps the number of concurrent sessions)
+type admission struct {
+	mutex   sync.Mutex
+	total   int
+	ips     map[string]int
+	keys    map[string][]*ticket // 依連線順序 (in connection order)
+	trusted []*net.IPNet
+	header  string // 信任代理設定的標頭 (the header set by the trusted proxies)
+}
+
+// ticket 一個Session佔用的名額，升級前取得，連線結束時釋放
+// (the slot taken by a session, acquired before the upgrade and released once the session ends)
+type ticket struct {
+	ip      string
+	key     string
+	s       *Session
+	release sync.Once
+}
+
+func newAdmission(o *Option) *admission {
+	a := &admission{ips: make(map[string]int), keys: make(map[string][]*ticket), header: o.ClientIPHeader}
+
+	for _, proxy := range o.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			a.trusted = append(a.trusted, network)
+		}
+	}
+
+	return a
+}
+
+func (a *admission) isTrusted(ip net.IP) bool {
+	for _, network := range a.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP 取得客戶端IP，只有來自信任的代理時才採用 ClientIPHeader
+// (the client IP, ClientIPHeader is only honoured from a trusted proxy)
+func (a *admission) clientIP(r *http.Request) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	ip := net.ParseIP(remote)
+	if ip == nil || !a.isTrusted(ip) {
+		return remote
+	}
+
+	// 由右往左，第一個不是信任代理的位址就是客戶端 (walking right to left, the first untrusted address is the client)
+	hops := forwardedFor(r, a.header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(hops[i])
+		if hop == nil {
+			break
+		}
+		if !a.isTrusted(hop) || i == 0 {
+			return hop.String()
+		}
+	}
+
+	return remote
+}
+
+// forwardedFor 讀取標頭中的位址，Forwarded 讀取 for=，其他標頭以逗號分隔 (the addresses in header, the for= of Forwarded, comma separated in any other header)
+// 只讀取設定的標頭，客戶端自行加上的其他標頭不會被採用 (only the configured header is read, others sent by the client are ignored)
+func forwardedFor(r *http.Request, name string) []string {
+	var hops []string
+
+	if !strings.EqualFold(name, "Forwarded") {
+		for _, header := range r.Header.Values(name) {
+			for _, hop := range strings.Split(header, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+
+		return hops
+	}
+
+	for _, header := range r.Header.Values("Forwarded") {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(name, "for") {
+					continue
+				}
+
+				value = strings.Trim(value, "\"")
+				if end := strings.Index(value, "]"); strings.HasPrefix(value, "[") && end > 0 {
+					value = value[1:end]
+				} else if host, _, err := net.SplitHostPort(value); err == nil {
+					value = host
+				}
+				hops = append(hops, value)
+			}
+		}
+	}
+
+	return hops
+}
+
+// acquire 取得名額，超過上限時回傳 AuthError (take a slot, returns an AuthError when over a cap)
+func (h *Hail) acquire(r *http.Request, identity Identity) (*ticket, error) {
+	a := h.admission
+	o := h.Option
+	t := &ticket{ip: a.clientIP(r)}
+
+	var limit int
+	if o.MaxSessionsPerKey != nil {
+		t.key, limit = o.MaxSessionsPerKey(r, identity)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// 先找出要關閉的Session，它們釋放的名額計入總數與IP的上限 (find the sessions to evict first, the slots they free count towards the total and IP caps)
+	var evicted []*ticket
+	if t.key != "" && limit > 0 && len(a.keys[t.key]) >= limit {
+		if !o.EvictOldest {
+			return nil, &AuthError{Status: http.StatusTooManyRequests, Message: ErrTooManySessions.Error()}
+		}
+
+		// 升級中的連線還沒有Session，不能關閉 (a connection still upgrading has no session to close yet)
+		need := len(a.keys[t.key]) - limit + 1
+		for _, old := range a.keys[t.key] {
+			if len(evicted) == need {
+				break
+			}
+			if old.s != nil {
+				evicted = append(evicted, old)
+			}
+		}
+
+		if len(evicted) < need {
+			return nil, &AuthError{Status: http.StatusTooManyRequests, Message: ErrTooManySessions.Error()}
+		}
+	}
+
+	sameIP := 0
+	for _, old := range evicted {
+		if old.ip == t.ip {
+			sameIP++
+		}
+	}
+
+	if o.MaxSessions > 0 && a.total-len(evicted) >= o.MaxSessions {
+		return nil, &AuthError{Status: http.StatusServiceUnavailable, Message: ErrTooManySessions.Error()}
+	}
+
+	if o.MaxSessionsPerIP > 0 && a.ips[t.ip]-sameIP >= o.MaxSessionsPerIP {
+		return nil, &AuthError{Status: http.StatusTooManyRequests, Message: ErrTooManySessions.Error()}
+	}
+
+	for _, old := range evicted {
+		old.release.Do(func() { a.remove(old) })
+		old.s.logger.Info("session evicted", "key", old.key)
+		go old.s.CloseWithReason(ClosePolicyViolation, "evicted by a newer session")
+	}
+
+	a.total++
+	a.ips[t.ip]++
+	if t.key != "" {
+		a.keys[t.key] = append(a.keys[t.key], t)
+	}
+
+	return t, nil
+}
+
+// attach 記錄取得名額的Session，供 EvictOldest 關閉 (record the session holding the slot, closed by EvictOldest)
+func (h *Hail) attach(t *ticket, s *Session) {
+	h.admission.mutex.Lock()
+	defer h.admission.mutex.Unlock()
+
+	t.s = s
+}
+
+// release 釋放名額 (give the slot back)
+func (h *Hail) release(t *ticket) {
+	if t == nil {
+		return
+	}
+
+	t.release.Do(func() {
+		h.admission.mutex.Lock()
+		h.admission.remove(t)
+		h.admission.mutex.Unlock()
+	})
+}
+
+// remove 在持有 mutex 時呼叫 (called with the mutex held)
+func (a *admission) remove(t *ticket) {
+	a.total--
+
+	if a.ips[t.ip]--; a.ips[t.ip] <= 0 {
+		delete(a.ips, t.ip)
+	}
+
+	tickets := a.keys[t.key]
+	for i, other := range tickets {
+		if other == t {
+			tickets = append(tickets[:i:i], tickets[i+1:]...)
+			break
+		}
+	}
+
+	if len(tickets) == 0 {
+		delete(a.keys, t.key)
+	} else {
+		a.keys[t.key] = tickets
+	}
+}
+
+// ClientIP returns the IP address of the client, taken from Option.ClientIPHeader when the
+// connection comes from one of Option.TrustedProxies. "Forwarded" is read as RFC 7239 and any other
+// header, such as X-Real-IP, as a comma separated list of IPs. No other header is read, so the
+// proxies must overwrite or append to that one rather than pass the client's value through.
+func (s *Session) ClientIP() string {
+	return s.ticket.ip
+}
@@ -0,0 +1,102 @@
+package hail_test
+
+import (
+	"github.com/lishank0119/hail"
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		proxies []string
+		header  string
+		sent    http.Header
+		want    string
+	}{
+		{"untrusted remote", nil, "", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "127.0.0.1"},
+		{"no header", []string{"127.0.0.1"}, "", nil, "127.0.0.1"},
+		{"x-forwarded-for", []string{"127.0.0.1"}, "", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "1.2.3.4"},
+		{"spoofed leftmost hop", []string{"127.0.0.1"}, "", http.Header{"X-Forwarded-For": {"6.6.6.6, 1.2.3.4"}}, "1.2.3.4"},
+		{"chain of proxies", []string{"127.0.0.1", "10.0.0.0/8"}, "", http.Header{"X-Forwarded-For": {"1.2.3.4, 10.0.0.1"}}, "1.2.3.4"},
+		{"forwarded sent by the client", []string{"127.0.0.1"}, "", http.Header{"X-Forwarded-For": {"1.2.3.4"}, "Forwarded": {"for=6.6.6.6"}}, "1.2.3.4"},
+		{"x-real-ip sent by the client", []string{"127.0.0.1"}, "", http.Header{"X-Real-Ip": {"6.6.6.6"}}, "127.0.0.1"},
+		{"forwarded", []string{"127.0.0.1"}, "Forwarded", http.Header{"Forwarded": {"for=1.2.3.4;proto=https"}, "X-Forwarded-For": {"6.6.6.6"}}, "1.2.3.4"},
+		{"forwarded ipv6", []string{"127.0.0.1"}, "Forwarded", http.Header{"Forwarded": {`for="[2001:db8::1]:4711"`}}, "2001:db8::1"},
+		{"x-real-ip", []string{"127.0.0.1"}, "X-Real-IP", http.Header{"X-Real-Ip": {"1.2.3.4"}, "X-Forwarded-For": {"6.6.6.6"}}, "1.2.3.4"},
+	} {
+		srv := newServer(t, &hail.Option{TrustedProxies: tt.proxies, ClientIPHeader: tt.header})
+		ips := make(chan string, 1)
+		srv.Hail.HandleConnect(func(s *hail.Session) {
+			ips <- s.ClientIP()
+		})
+
+		c := srv.DialWith(t, "", tt.sent)
+		if ip := <-ips; ip != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, ip, tt.want)
+		}
+		c.Drop()
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	from := func(ip string) http.Header {
+		return http.Header{"X-Forwarded-For": {ip}}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		option hail.Option
+		dials  []http.Header
+		want   []int
+	}{
+		{"total", hail.Option{MaxSessions: 2, TrustedProxies: []string{"127.0.0.1"}},
+			[]http.Header{from("1.1.1.1"), from("2.2.2.2"), from("3.3.3.3")},
+			[]int{http.StatusSwitchingProtocols, http.StatusSwitchingProtocols, http.StatusServiceUnavailable}},
+		{"per ip", hail.Option{MaxSessionsPerIP: 1},
+			[]http.Header{nil, nil},
+			[]int{http.StatusSwitchingProtocols, http.StatusTooManyRequests}},
+		{"per ip behind a proxy", hail.Option{MaxSessionsPerIP: 1, TrustedProxies: []string{"127.0.0.1"}},
+			[]http.Header{from("1.1.1.1"), from("2.2.2.2"), from("1.1.1.1")},
+			[]int{http.StatusSwitchingProtocols, http.StatusSwitchingProtocols, http.StatusTooManyRequests}},
+		{"per ip ignores other headers", hail.Option{MaxSessionsPerIP: 1, TrustedProxies: []string{"127.0.0.1"}},
+			[]http.Header{from("1.1.1.1"), {"X-Forwarded-For": {"1.1.1.1"}, "Forwarded": {"for=3.3.3.3"}, "X-Real-Ip": {"4.4.4.4"}}},
+			[]int{http.StatusSwitchingProtocols, http.StatusTooManyRequests}},
+		{"untrusted proxy", hail.Option{MaxSessionsPerIP: 1},
+			[]http.Header{from("1.1.1.1"), from("2.2.2.2")},
+			[]int{http.StatusSwitchingProtocols, http.StatusTooManyRequests}},
+	} {
+		o := tt.option
+		srv := newServer(t, &o)
+
+		for i, header := range tt.dials {
+			c, res := srv.TryDial(t, "", header)
+			if res.StatusCode != tt.want[i] {
+				t.Errorf("%s: dial %d got %d, want %d", tt.name, i, res.StatusCode, tt.want[i])
+			}
+			if c != nil {
+				defer c.Drop()
+			}
+		}
+	}
+}
+
+func TestEvictOldestFreesGlobalSlot(t *testing.T) {
+	srv := newServer(t, &hail.Option{
+		MaxSessions: 1,
+		MaxSessionsPerKey: func(r *http.Request, identity hail.Identity) (string, int) {
+			return "alice", 1
+		},
+		EvictOldest: true,
+	})
+
+	old := srv.Dial(t)
+	c, res := srv.TryDial(t, "", nil)
+	if c == nil {
+		t.Fatalf("got %s, want the oldest session evicted", res.Status)
+	}
+
+	old.ExpectClose(hail.ClosePolicyViolation)
+	c.Send("still here")
+	c.Expect("still here")
+}
@@ -0,0 +1,164 @@
+package hail
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Identity is the authenticated identity of a session, returned by Option.Authenticate.
+// A non-empty UserID binds the session to that user, see Session.BindUser.
+type Identity struct {
+	UserID string                 `json:"sub"`
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+// AuthError rejects a connection from Option.Authenticate with an HTTP status, such as
+// http.StatusUnauthorized, http.StatusForbidden or http.StatusTooManyRequests, and Message as body.
+// A Status outside 400-599 answers 401 and an empty Message the text of the status. Other
+// errors of Option.Authenticate are logged and answered with a plain 401.
+type AuthError struct {
+	Status  int
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return e.Message
+}
+
+// reject 以HTTP狀態碼拒絕連線，非 AuthError 的錯誤回傳401，錯誤內容只記錄不回傳
+// (reject the connection with an HTTP status, errors other than AuthError answer 401 and are only logged)
+func (h *Hail) reject(w http.ResponseWriter, r *http.Request, err error) {
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		authErr = &AuthError{Status: http.StatusUnauthorized}
+	}
+
+	status, message := authErr.Status, authErr.Message
+	if status < 400 || status > 599 {
+		status = http.StatusUnauthorized
+	}
+	if message == "" {
+		message = http.StatusText(status)
+	}
+
+	h.Option.Logger.Info("connection rejected", logRemoteAddr, r.RemoteAddr, "status", status, "error", err)
+	http.Error(w, message, status)
+}
+
+// Identity returns the identity Option.Authenticate attached to the session.
+func (s *Session) Identity() Identity {
+	return s.identity
+}
+
+// TokenVerifier verifies a token and returns the identity it carries.
+type TokenVerifier interface {
+	Verify(token string) (Identity, error)
+}
+
+// Authenticate returns an Option.Authenticate function reading a token from the
+// "Authorization: Bearer" header, or from the "token" query parameter, and verifying it with v.
+// Missing and invalid tokens are rejected with 401.
+func Authenticate(v TokenVerifier) func(*http.Request) (Identity, map[string]interface{}, error) {
+	return func(r *http.Request) (Identity, map[string]interface{}, error) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+
+		if token == "" {
+			return Identity{}, nil, &AuthError{Status: http.StatusUnauthorized, Message: ErrMissingToken.Error()}
+		}
+
+		// 驗證器的錯誤可能帶有內部細節，只回傳固定的訊息 (the error of the verifier may hold internal details, answer a fixed message)
+		identity, err := v.Verify(token)
+		if errors.Is(err, ErrTokenExpired) {
+			return Identity{}, nil, &AuthError{Status: http.StatusUnauthorized, Message: ErrTokenExpired.Error()}
+		}
+		if err != nil {
+			return Identity{}, nil, &AuthError{Status: http.StatusUnauthorized, Message: ErrInvalidToken.Error()}
+		}
+
+		return identity, nil, nil
+	}
+}
+
+// HMACVerifier signs and verifies tokens made of a base64url JSON payload and its base64url
+// HMAC-SHA256 signature, joined by a ".".
+type HMACVerifier struct {
+	secret []byte
+}
+
+// hmacPayload Token的內容 (the payload of a token)
+type hmacPayload struct {
+	Identity
+	Expires int64 `json:"exp,omitempty"` // unix seconds, 0 never expires
+}
+
+// NewHMACVerifier creates a HMACVerifier signing with a copy of secret. It returns ErrEmptySecret
+// when secret is empty, since anyone could then sign a token.
+func NewHMACVerifier(secret []byte) (*HMACVerifier, error) {
+	if len(secret) == 0 {
+		return nil, ErrEmptySecret
+	}
+
+	return &HMACVerifier{secret: bytes.Clone(secret)}, nil
+}
+
+// Sign returns a token carrying identity, expiring after ttl, or never when ttl is 0.
+func (v *HMACVerifier) Sign(identity Identity, ttl time.Duration) (string, error) {
+	payload := hmacPayload{Identity: identity}
+	if ttl > 0 {
+		payload.Expires = time.Now().Add(ttl).Unix()
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(data)
+
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(v.sign(encoded)), nil
+}
+
+// Verify checks the signature and the expiry of token and returns its identity.
+func (v *HMACVerifier) Verify(token string) (Identity, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return Identity{}, ErrInvalidToken
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, v.sign(encoded)) {
+		return Identity{}, ErrInvalidToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Identity{}, ErrInvalidToken
+	}
+
+	var payload hmacPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return Identity{}, ErrInvalidToken
+	}
+
+	if payload.Expires != 0 && time.Now().Unix() >= payload.Expires {
+		return Identity{}, ErrTokenExpired
+	}
+
+	return payload.Identity, nil
+}
+
+func (v *HMACVerifier) sign(encoded string) []byte {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,168 @@
+package hail_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/hailtest"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRejectHidesErrors(t *testing.T) {
+	for _, tt := range []struct {
+		err    error
+		status int
+		body   string
+	}{
+		{errors.New("dial tcp 10.0.0.5:5432: connection refused"), http.StatusUnauthorized, "Unauthorized"},
+		{&hail.AuthError{Status: http.StatusOK}, http.StatusUnauthorized, "Unauthorized"},
+		{&hail.AuthError{Status: http.StatusForbidden}, http.StatusForbidden, "Forbidden"},
+		{&hail.AuthError{Status: http.StatusForbidden, Message: "banned"}, http.StatusForbidden, "banned"},
+	} {
+		err := tt.err
+		h := hail.New(&hail.Option{
+			Authenticate: func(r *http.Request) (hail.Identity, map[string]interface{}, error) {
+				return hail.Identity{}, nil, err
+			},
+		})
+		srv := hailtest.NewServer(h)
+
+		_, res := srv.TryDial(t, "", nil)
+		body, _ := io.ReadAll(res.Body)
+		if res.StatusCode != tt.status || strings.TrimSpace(string(body)) != tt.body {
+			t.Errorf("%v: got %d %q, want %d %q", err, res.StatusCode, body, tt.status, tt.body)
+		}
+		srv.Close()
+	}
+}
+
+func TestAnonymousCannotResumeBoundSession(t *testing.T) {
+	srv := newServer(t, &hail.Option{ResumeGrace: time.Minute})
+	h := srv.Hail
+
+	resumed := make(chan bool, 2)
+	h.HandleConnect(func(s *hail.Session) {
+		resumed <- s.Resumed()
+		if !s.Resumed() && s.Request.URL.Query().Get("resume_token") == "" {
+			s.BindUser("alice")
+		}
+	})
+	parked := make(chan struct{}, 1)
+	h.HandleDisconnectInfo(func(s *hail.Session, info hail.DisconnectInfo) {
+		if info.Parked {
+			parked <- struct{}{}
+		}
+	})
+
+	c := srv.Dial(t)
+	<-resumed
+	token := c.Response.Header.Get("X-Hail-Resume-Token")
+	c.Drop()
+	<-parked
+
+	srv.DialWith(t, "resume_token="+token, nil)
+	if <-resumed {
+		t.Fatal("an anonymous connection resumed the session of alice")
+	}
+}
+
+func TestNewHMACVerifierRejectsEmptySecret(t *testing.T) {
+	for _, secret := range [][]byte{nil, {}} {
+		if v, err := hail.NewHMACVerifier(secret); v != nil || err != hail.ErrEmptySecret {
+			t.Errorf("%q: got %v, %v, want ErrEmptySecret", secret, v, err)
+		}
+	}
+}
+
+// hmacToken 以secret簽署payload，用來產生過期或竄改的Token (sign payload with secret, to make expired or tampered tokens)
+func hmacToken(secret, payload string) string {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestHMACVerifier(t *testing.T) {
+	v, err := hail.NewHMACVerifier([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := v.Sign(hail.Identity{UserID: "alice", Claims: map[string]interface{}{"role": "admin"}}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := v.Verify(token)
+	if err != nil || identity.UserID != "alice" || identity.Claims["role"] != "admin" {
+		t.Fatalf("got %+v, %v", identity, err)
+	}
+
+	encoded, signature, _ := strings.Cut(token, ".")
+	for _, tt := range []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"no expiry", hmacToken("secret", `{"sub":"alice"}`), nil},
+		{"expired", hmacToken("secret", `{"sub":"alice","exp":1}`), hail.ErrTokenExpired},
+		{"other secret", hmacToken("other", `{"sub":"alice"}`), hail.ErrInvalidToken},
+		{"tampered payload", base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory"}`)) + "." + signature, hail.ErrInvalidToken},
+		{"tampered signature", encoded + "." + base64.RawURLEncoding.EncodeToString([]byte("forged")), hail.ErrInvalidToken},
+		{"no signature", encoded, hail.ErrInvalidToken},
+		{"not json", hmacToken("secret", "alice"), hail.ErrInvalidToken},
+	} {
+		if _, err := v.Verify(tt.token); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestAuthenticateReadsToken(t *testing.T) {
+	v, _ := hail.NewHMACVerifier([]byte("secret"))
+	valid, _ := v.Sign(hail.Identity{UserID: "alice"}, time.Hour)
+	expired := hmacToken("secret", `{"sub":"alice","exp":1}`)
+
+	srv := newServer(t, &hail.Option{Authenticate: hail.Authenticate(v)})
+	users := make(chan string, 1)
+	srv.Hail.HandleConnect(func(s *hail.Session) {
+		users <- s.Identity().UserID
+	})
+
+	for _, tt := range []struct {
+		name   string
+		query  string
+		header http.Header
+		status int
+		body   string
+	}{
+		{"header", "", http.Header{"Authorization": {"Bearer " + valid}}, http.StatusSwitchingProtocols, ""},
+		{"query", "token=" + valid, nil, http.StatusSwitchingProtocols, ""},
+		{"missing", "", nil, http.StatusUnauthorized, hail.ErrMissingToken.Error()},
+		{"invalid", "token=" + valid + "x", nil, http.StatusUnauthorized, hail.ErrInvalidToken.Error()},
+		{"expired", "", http.Header{"Authorization": {"Bearer " + expired}}, http.StatusUnauthorized, hail.ErrTokenExpired.Error()},
+	} {
+		c, res := srv.TryDial(t, tt.query, tt.header)
+		if res.StatusCode != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.name, res.StatusCode, tt.status)
+			continue
+		}
+		if c != nil {
+			if user := <-users; user != "alice" {
+				t.Errorf("%s: got user %q, want alice", tt.name, user)
+			}
+			c.Drop()
+			continue
+		}
+
+		body, _ := io.ReadAll(res.Body)
+		if strings.TrimSpace(string(body)) != tt.body {
+			t.Errorf("%s: got %q, want %q", tt.name, body, tt.body)
+		}
+	}
+}
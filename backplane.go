@@ -0,0 +1,237 @@
+package hail
+
+import (
+	"github.com/lesismal/nbio/nbhttp/websocket"
+	"sync"
+	"time"
+)
+
+// BackplaneKind 節點之間傳遞的訊息種類 (the kind of a message exchanged between nodes)
+type BackplaneKind string
+
+const (
+	BackplaneBroadcast       BackplaneKind = "broadcast"        // Broadcast and BroadcastBinary
+	BackplaneBroadcastFilter BackplaneKind = "broadcast_filter" // BroadcastNamedFilter, Target is the filter name
+	BackplanePublish         BackplaneKind = "publish"          // Pub*Msg to Topics
+	BackplaneSendTo          BackplaneKind = "send_to"          // SendTo, Target is the session hashID
+	BackplaneSendToUser      BackplaneKind = "send_to_user"     // SendToUser, Target is the userID
+	BackplaneNodeLeave       BackplaneKind = "node_leave"       // the node shut down, its sessions are gone
+)
+
+// BackplaneMessage is a message exchanged between the nodes of a cluster.
+type BackplaneMessage struct {
+	Kind   BackplaneKind `json:"kind"`
+	Node   string        `json:"node"`             // the node that sent the message
+	Type   int           `json:"type"`             // websocket message type, text or binary
+	Data   []byte        `json:"data,omitempty"`   // message payload
+	Topics []string      `json:"topics,omitempty"` // topics of a publish
+	Target string        `json:"target,omitempty"` // session hashID, userID or filter name
+	User   string        `json:"user,omitempty"`   // userID of a session join
+	Async  bool          `json:"async,omitempty"`  // the publish was asynchronous
+	Trace  *SpanContext  `json:"trace,omitempty"`  // span of the message on the sending node
+}
+
+// Backplane connects the Hail instances of several nodes, so that broadcasts, named filter
+// broadcasts, topic publishes and SendTo reach sessions connected to any node.
+// See the backplane package for an in-memory and a TCP peer-mesh implementation.
+type Backplane interface {
+	// NodeID returns the ID of the local node.
+	NodeID() string
+	// Publish sends msg to every other node.
+	Publish(msg *BackplaneMessage) error
+	// Subscribe registers the functions called when a message arrives from another node,
+	// and when another node joins (up is true) or leaves the cluster.
+	Subscribe(onMessage func(*BackplaneMessage), onNode func(node string, up bool)) error
+	// Nodes returns the IDs of the other nodes currently reachable.
+	Nodes() []string
+	// Close leaves the cluster.
+	Close() error
+}
+
+type handleNodeFunc func(string, bool)
+
+// backplaneRetryInterval New 重試 Backplane.Subscribe 的間隔 (how often New retries Backplane.Subscribe)
+const backplaneRetryInterval = time.Second
+
+// filters 具名的過濾函式，每個節點都要註冊相同的名稱 (named filters, every node registers the same names)
+type filters struct {
+	rwMutex sync.RWMutex
+	fns     map[string]filterFunc
+}
+
+// HandleNode fires fn when another node joins (up is true) or leaves the cluster.
+func (h *Hail) HandleNode(fn func(node string, up bool)) {
+	h.nodeHandler = fn
+}
+
+// HandleBackplaneError fires fn when the Backplane fails to subscribe or to publish a message,
+// or a message from another node cannot be decoded.
+func (h *Hail) HandleBackplaneError(fn func(error)) {
+	h.backplaneErrorHandler = fn
+}
+
+// backplaneError 記錄與回報不屬於任何Session的錯誤 (log and report an error that belongs to no session)
+func (h *Hail) backplaneError(err error) {
+	h.Option.Logger.Warn("backplane error", "error", err)
+	h.backplaneErrorHandler(err)
+}
+
+// subscribeBackplane 訂閱 Backplane，失敗時回報錯誤並重試，直到關機 (subscribe to the Backplane, reporting a failure and retrying until shutdown)
+func (h *Hail) subscribeBackplane() {
+	if h.hub.closed() {
+		return
+	}
+
+	if err := h.Option.Backplane.Subscribe(h.receive, h.nodeChanged); err != nil {
+		h.backplaneError(err)
+		h.Option.Clock.AfterFunc(backplaneRetryInterval, h.subscribeBackplane)
+	}
+}
+
+// leaveCluster 通知其他節點本節點的Session已離開，並關閉 Backplane (tell the other nodes the sessions of this node are gone and close the Backplane)
+func (h *Hail) leaveCluster() {
+	if h.Option.Backplane == nil {
+		return
+	}
+
+	if err := h.Option.Backplane.Publish(&BackplaneMessage{Kind: BackplaneNodeLeave, Node: h.nodeID()}); err != nil {
+		h.backplaneError(err)
+	}
+
+	if err := h.Option.Backplane.Close(); err != nil {
+		h.backplaneError(err)
+	}
+}
+
+// Nodes returns the IDs of the other nodes reachable through the Backplane.
+func (h *Hail) Nodes() []string {
+	if h.Option.Backplane == nil {
+		return nil
+	}
+
+	return h.Option.Backplane.Nodes()
+}
+
+// RegisterFilter registers fn under name for BroadcastNamedFilter. Functions cannot travel
+// between nodes, so every node must register the same names.
+func (h *Hail) RegisterFilter(name string, fn func(*Session) bool) {
+	h.filters.rwMutex.Lock()
+	defer h.filters.rwMutex.Unlock()
+
+	h.filters.fns[name] = fn
+}
+
+func (h *Hail) filter(name string) (filterFunc, bool) {
+	h.filters.rwMutex.RLock()
+	defer h.filters.rwMutex.RUnlock()
+
+	fn, ok := h.filters.fns[name]
+	return fn, ok
+}
+
+// BroadcastNamedFilter broadcasts a text message, on every node, to the sessions that the filter
+// registered under name returns true for.
+func (h *Hail) BroadcastNamedFilter(msg []byte, name string) error {
+	return h.broadcastNamedFilter(&box{t: websocket.TextMessage, msg: msg}, name)
+}
+
+// BroadcastBinaryNamedFilter broadcasts a binary message, on every node, to the sessions that
+// the filter registered under name returns true for.
+func (h *Hail) BroadcastBinaryNamedFilter(msg []byte, name string) error {
+	return h.broadcastNamedFilter(&box{t: websocket.BinaryMessage, msg: msg}, name)
+}
+
+func (h *Hail) broadcastNamedFilter(message *box, name string) error {
+	fn, ok := h.filter(name)
+	if !ok {
+		return ErrFilterNotFound
+	}
+
+	if h.hub.closed() {
+		return ErrClose
+	}
+
+	message.filter = fn
+	span := h.startMessage("hail.broadcast", message, nil)
+	defer span.End()
+
+	if !h.hub.send(h.hub.broadcast, message) {
+		return ErrClose
+	}
+
+	h.forward(&BackplaneMessage{Kind: BackplaneBroadcastFilter, Target: name}, message)
+
+	return nil
+}
+
+// forward 將訊息送往其他節點 (send a message to the other nodes)
+func (h *Hail) forward(m *BackplaneMessage, message *box) {
+	if h.Option.Backplane == nil {
+		return
+	}
+
+	m.Node = h.Option.Backplane.NodeID()
+	m.Type = int(message.t)
+	m.Data = message.msg
+	if message.trace.IsValid() {
+		trace := message.trace
+		m.Trace = &trace
+	}
+
+	if err := h.Option.Backplane.Publish(m); err != nil {
+		h.backplaneError(err)
+	}
+}
+
+// receive 處理其他節點送來的訊息，只送給本地的Session (handle a message from another node, delivering to local sessions only)
+func (h *Hail) receive(m *BackplaneMessage) {
+	if m.Node == h.Option.Backplane.NodeID() || h.hub.closed() {
+		return
+	}
+
+	message := &box{t: websocket.MessageType(m.Type), msg: m.Data, created: time.Now()}
+	if m.Trace != nil {
+		message.trace = *m.Trace
+	}
+
+	switch m.Kind {
+	case BackplaneSessionJoin, BackplaneSessionLeave, BackplaneDirectorySync:
+		h.receiveDirectory(m)
+
+	case BackplaneNodeLeave:
+		h.nodeLeft(m.Node)
+
+	case BackplaneBroadcast:
+		h.hub.send(h.hub.broadcast, message)
+
+	case BackplaneBroadcastFilter:
+		if fn, ok := h.filter(m.Target); ok {
+			message.filter = fn
+			h.hub.send(h.hub.broadcast, message)
+		}
+
+	case BackplanePublish:
+		if !validTopicNames(m.Topics) {
+			h.backplaneError(ErrInvalidTopic)
+			return
+		}
+
+		var report PubReport
+		if m.Async {
+			report = h.pubSub.AsyncPub(message, m.Topics...)
+		} else {
+			report = h.pubSub.Pub(message, m.Topics...)
+		}
+		h.observers.fanout("publish", report.Subscribers)
+
+	case BackplaneSendTo:
+		if s, ok := h.hub.get(m.Target); ok {
+			s.writeMessage(message)
+		}
+
+	case BackplaneSendToUser:
+		for _, s := range h.hub.userSessions(m.Target) {
+			s.writeMessage(message)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Package backplane provides implementations of hail.Backplane.
+package backplane
+
+import (
+	"errors"
+	"github.com/lishank0119/hail"
+	"sort"
+	"sync"
+)
+
+// ErrClosed is returned when the backplane has been closed.
+var ErrClosed = errors.New("backplane is closed")
+
+// Network 在同一個程序中模擬的叢集，用於測試 (a cluster simulated inside one process, for tests)
+type Network struct {
+	mutex sync.RWMutex
+	nodes map[string]*Memory
+}
+
+// NewNetwork creates an empty in-memory cluster.
+func NewNetwork() *Network {
+	return &Network{nodes: make(map[string]*Memory)}
+}
+
+// Join creates the backplane of a node named nodeID and adds it to the network.
+func (n *Network) Join(nodeID string) *Memory {
+	m := &Memory{
+		network: n,
+		id:      nodeID,
+		inbox:   make(chan func(), 1024),
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go m.run()
+
+	n.mutex.Lock()
+	peers := n.peers(nodeID)
+	n.nodes[nodeID] = m
+	n.mutex.Unlock()
+
+	for _, peer := range peers {
+		peer.nodeChanged(nodeID, true)
+		m.nodeChanged(peer.id, true)
+	}
+
+	return m
+}
+
+// peers must be called with mutex held.
+func (n *Network) peers(except string) []*Memory {
+	peers := make([]*Memory, 0, len(n.nodes))
+	for id, m := range n.nodes {
+		if id != except {
+			peers = append(peers, m)
+		}
+	}
+
+	return peers
+}
+
+// Memory is a hail.Backplane connected to the other nodes of a Network.
+// Messages are delivered in order, from a goroutine per node. Messages and node changes
+// arriving before Subscribe are kept until it is called.
+type Memory struct {
+	network    *Network
+	id         string
+	inbox      chan func()
+	ready      chan struct{} // Subscribe 之後關閉，開始處理 inbox (closed by Subscribe, the inbox is handled from then on)
+	done       chan struct{}
+	once       sync.Once
+	subscribed sync.Once
+
+	rwMutex   sync.RWMutex
+	onMessage func(*hail.BackplaneMessage)
+	onNode    func(string, bool)
+}
+
+func (m *Memory) run() {
+	select {
+	case <-m.ready:
+	case <-m.done:
+		return
+	}
+
+	for {
+		select {
+		case fn := <-m.inbox:
+			fn()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *Memory) deliver(fn func()) {
+	select {
+	case m.inbox <- fn:
+	case <-m.done:
+	}
+}
+
+func (m *Memory) nodeChanged(node string, up bool) {
+	m.deliver(func() {
+		m.rwMutex.RLock()
+		onNode := m.onNode
+		m.rwMutex.RUnlock()
+
+		if onNode != nil {
+			onNode(node, up)
+		}
+	})
+}
+
+// NodeID returns the ID of the node.
+func (m *Memory) NodeID() string {
+	return m.id
+}
+
+// Publish delivers msg to every other node of the network.
+func (m *Memory) Publish(msg *hail.BackplaneMessage) error {
+	select {
+	case <-m.done:
+		return ErrClosed
+	default:
+	}
+
+	m.network.mutex.RLock()
+	peers := m.network.peers(m.id)
+	m.network.mutex.RUnlock()
+
+	for _, peer := range peers {
+		peer := peer
+		copied := *msg
+		peer.deliver(func() {
+			peer.rwMutex.RLock()
+			onMessage := peer.onMessage
+			peer.rwMutex.RUnlock()
+
+			if onMessage != nil {
+				onMessage(&copied)
+			}
+		})
+	}
+
+	return nil
+}
+
+// Subscribe registers the functions called for incoming messages and node changes.
+func (m *Memory) Subscribe(onMessage func(*hail.BackplaneMessage), onNode func(node string, up bool)) error {
+	m.rwMutex.Lock()
+	m.onMessage = onMessage
+	m.onNode = onNode
+	m.rwMutex.Unlock()
+
+	m.subscribed.Do(func() { close(m.ready) })
+
+	return nil
+}
+
+// Nodes returns the IDs of the other nodes of the network.
+func (m *Memory) Nodes() []string {
+	m.network.mutex.RLock()
+	defer m.network.mutex.RUnlock()
+
+	nodes := make([]string, 0, len(m.network.nodes))
+	for _, peer := range m.network.peers(m.id) {
+		nodes = append(nodes, peer.id)
+	}
+	sort.Strings(nodes)
+
+	return nodes
+}
+
+// Close removes the node from the network, the other nodes see it leave.
+func (m *Memory) Close() error {
+	m.once.Do(func() {
+		m.network.mutex.Lock()
+		if m.network.nodes[m.id] == m {
+			delete(m.network.nodes, m.id)
+		}
+		peers := m.network.peers(m.id)
+		m.network.mutex.Unlock()
+
+		close(m.done)
+
+		for _, peer := range peers {
+			peer.nodeChanged(m.id, false)
+		}
+	})
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package backplane_test
+
+import (
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/backplane"
+	"testing"
+	"time"
+)
+
+func TestMemoryKeepsEventsUntilSubscribe(t *testing.T) {
+	network := backplane.NewNetwork()
+	a := network.Join("a")
+	b := network.Join("b")
+	defer a.Close()
+	defer b.Close()
+
+	a.Publish(&hail.BackplaneMessage{Kind: hail.BackplaneBroadcast, Node: "a"})
+
+	nodes := make(chan string, 1)
+	messages := make(chan *hail.BackplaneMessage, 1)
+	b.Subscribe(func(m *hail.BackplaneMessage) {
+		messages <- m
+	}, func(node string, up bool) {
+		if up {
+			nodes <- node
+		}
+	})
+
+	select {
+	case node := <-nodes:
+		if node != "a" {
+			t.Fatalf("got node %q, want a", node)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the join of a was lost")
+	}
+
+	select {
+	case m := <-messages:
+		if m.Kind != hail.BackplaneBroadcast {
+			t.Fatalf("got %s, want broadcast", m.Kind)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the message of a was lost")
+	}
+}
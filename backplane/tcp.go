@@ -0,0 +1,468 @@
+package backplane
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/lishank0119/hail"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 連線時的握手訊框 (the frames of the handshake of a connection)
+const (
+	kindHello     hail.BackplaneKind = "hello"     // 第一個訊框，告知對方自己的節點ID (the first frame, naming the dialing node)
+	kindChallenge hail.BackplaneKind = "challenge" // 有 Secret 時，接受端送出的隨機數 (the nonce sent by the accepting node when a Secret is set)
+	kindAuth      hail.BackplaneKind = "auth"      // 連線端對隨機數的 HMAC (the HMAC of the nonce by the dialing node)
+)
+
+const maxFrameSize = 64 << 20
+
+const (
+	// maxHandshakeSize 握手訊框的大小上限，驗證前不配置更大的緩衝 (the size cap of a handshake frame, nothing larger is allocated before authentication)
+	maxHandshakeSize = 512
+	// handshakeTimeout 握手要在這段時間內完成 (the handshake must complete within this time)
+	handshakeTimeout = 5 * time.Second
+	nonceSize        = 32
+)
+
+var (
+	// ErrQueueFull is returned by Publish when the queue of a peer is full.
+	ErrQueueFull = errors.New("backplane peer queue is full")
+	// ErrFrameTooLarge is returned when a frame exceeds 64 MiB.
+	ErrFrameTooLarge = errors.New("backplane frame is too large")
+
+	errHandshake = errors.New("backplane handshake failed")
+)
+
+// TCPConfig configures a TCP peer mesh.
+type TCPConfig struct {
+	NodeID        string        // ID of the local node, unique in the cluster
+	ListenAddr    string        // address the other nodes dial
+	Peers         []string      // addresses of the other nodes
+	RetryInterval time.Duration // delay before redialing a lost peer, 1s by default
+	QueueSize     int           // messages buffered per peer while it is unreachable, 1024 by default
+	// Secret 所有節點共用的密鑰，用來驗證連入的節點 (shared by every node, authenticates the nodes dialing in)
+	// Without it any host reaching ListenAddr can join the mesh and inject messages.
+	Secret []byte
+}
+
+// TCP is a hail.Backplane where every node dials every other node, no broker is needed.
+// Each node sends on the connections it dialed and receives on the connections it accepted.
+//
+// Frames are neither encrypted nor, without TCPConfig.Secret, authenticated: set a Secret and
+// keep ListenAddr on a private network. With a Secret, the accepting node sends a random nonce
+// and the dialing node answers with an HMAC of its node ID and the nonce. Frames whose Node
+// differs from the node that authenticated the connection are dropped.
+type TCP struct {
+	config   TCPConfig
+	listener net.Listener
+	peers    []*tcpPeer
+
+	rwMutex   sync.RWMutex
+	nodes     map[string]int // Key: node ID, Value: 已接受的連線數 (accepted connections)
+	inbound   map[net.Conn]bool
+	onMessage func(*hail.BackplaneMessage)
+	onNode    func(string, bool)
+
+	start sync.Once
+	stop  sync.Once
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+type tcpPeer struct {
+	addr  string
+	queue chan []byte
+}
+
+// NewTCP listens on config.ListenAddr. The mesh starts once Subscribe is called.
+func NewTCP(config TCPConfig) (*TCP, error) {
+	if config.NodeID == "" {
+		return nil, errors.New("backplane: NodeID is required")
+	}
+
+	if config.RetryInterval == 0 {
+		config.RetryInterval = time.Second
+	}
+
+	if config.QueueSize == 0 {
+		config.QueueSize = 1024
+	}
+
+	listener, err := net.Listen("tcp", config.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TCP{
+		config:   config,
+		listener: listener,
+		nodes:    make(map[string]int),
+		inbound:  make(map[net.Conn]bool),
+		done:     make(chan struct{}),
+	}
+
+	for _, addr := range config.Peers {
+		t.peers = append(t.peers, &tcpPeer{addr: addr, queue: make(chan []byte, config.QueueSize)})
+	}
+
+	return t, nil
+}
+
+// Addr returns the address the node listens on.
+func (t *TCP) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// NodeID returns the ID of the local node.
+func (t *TCP) NodeID() string {
+	return t.config.NodeID
+}
+
+// Publish queues msg for every peer. Messages queued while a peer is unreachable are sent once
+// it is reconnected; ErrQueueFull is returned when a queue overflows.
+func (t *TCP) Publish(msg *hail.BackplaneMessage) error {
+	select {
+	case <-t.done:
+		return ErrClosed
+	default:
+	}
+
+	frame, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	var result error
+	for _, peer := range t.peers {
+		select {
+		case peer.queue <- frame:
+		default:
+			result = ErrQueueFull
+		}
+	}
+
+	return result
+}
+
+// Subscribe registers the functions called for incoming messages and node changes,
+// then starts accepting and dialing the peers.
+func (t *TCP) Subscribe(onMessage func(*hail.BackplaneMessage), onNode func(node string, up bool)) error {
+	t.rwMutex.Lock()
+	t.onMessage = onMessage
+	t.onNode = onNode
+	t.rwMutex.Unlock()
+
+	t.start.Do(func() {
+		t.wg.Add(1)
+		go t.accept()
+
+		for _, peer := range t.peers {
+			t.wg.Add(1)
+			go t.dial(peer)
+		}
+	})
+
+	return nil
+}
+
+// Nodes returns the IDs of the nodes connected to this node.
+func (t *TCP) Nodes() []string {
+	t.rwMutex.RLock()
+	defer t.rwMutex.RUnlock()
+
+	nodes := make([]string, 0, len(t.nodes))
+	for node := range t.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	return nodes
+}
+
+// Close stops the listener and every connection.
+func (t *TCP) Close() error {
+	var err error
+
+	t.stop.Do(func() {
+		close(t.done)
+		err = t.listener.Close()
+
+		t.rwMutex.Lock()
+		for conn := range t.inbound {
+			conn.Close()
+		}
+		t.rwMutex.Unlock()
+
+		t.wg.Wait()
+	})
+
+	return err
+}
+
+func (t *TCP) accept() {
+	defer t.wg.Done()
+
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.done:
+				return
+			default:
+			}
+
+			time.Sleep(t.config.RetryInterval)
+			continue
+		}
+
+		t.rwMutex.Lock()
+		t.inbound[conn] = true
+		t.rwMutex.Unlock()
+
+		t.wg.Add(1)
+		go t.read(conn)
+	}
+}
+
+// read 讀取對方節點送來的訊息 (read the messages sent by a peer)
+func (t *TCP) read(conn net.Conn) {
+	defer t.wg.Done()
+	defer func() {
+		conn.Close()
+		t.rwMutex.Lock()
+		delete(t.inbound, conn)
+		t.rwMutex.Unlock()
+	}()
+
+	node, ok := t.authenticate(conn)
+	if !ok {
+		return
+	}
+
+	t.nodeUp(node)
+	defer t.nodeDown(node)
+
+	for {
+		msg, err := readMessage(conn, maxFrameSize)
+		if err != nil {
+			return
+		}
+
+		// 節點只能代表自己發送 (a node only speaks for itself)
+		if msg.Node != node {
+			continue
+		}
+
+		t.rwMutex.RLock()
+		onMessage := t.onMessage
+		t.rwMutex.RUnlock()
+
+		if onMessage != nil {
+			onMessage(msg)
+		}
+	}
+}
+
+func (t *TCP) nodeUp(node string) {
+	t.rwMutex.Lock()
+	t.nodes[node]++
+	joined := t.nodes[node] == 1
+	onNode := t.onNode
+	t.rwMutex.Unlock()
+
+	if joined && onNode != nil {
+		onNode(node, true)
+	}
+}
+
+func (t *TCP) nodeDown(node string) {
+	t.rwMutex.Lock()
+	t.nodes[node]--
+	left := t.nodes[node] == 0
+	if left {
+		delete(t.nodes, node)
+	}
+	onNode := t.onNode
+	t.rwMutex.Unlock()
+
+	if left && onNode != nil {
+		onNode(node, false)
+	}
+}
+
+// dial 連線到對方節點並送出排隊的訊息，斷線後重試 (connect to a peer and send its queue, redialing when the connection is lost)
+func (t *TCP) dial(peer *tcpPeer) {
+	defer t.wg.Done()
+
+	for {
+		conn, err := net.DialTimeout("tcp", peer.addr, t.config.RetryInterval)
+		if err == nil {
+			if t.handshake(conn) == nil {
+				t.send(conn, peer)
+			}
+			conn.Close()
+		}
+
+		select {
+		case <-t.done:
+			return
+		case <-time.After(t.config.RetryInterval):
+		}
+	}
+}
+
+// send 送出排隊的訊息，直到連線中斷或關閉 (write the queued messages until the connection breaks or the mesh is closed)
+func (t *TCP) send(conn net.Conn, peer *tcpPeer) {
+	// 對方不會在這條連線上送資料，讀取只用來發現斷線 (the peer never writes on this connection, reading only detects a break)
+	broken := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(broken)
+	}()
+
+	for {
+		select {
+		case frame := <-peer.queue:
+			if writeFrame(conn, frame) != nil {
+				return
+			}
+		case <-broken:
+			return
+		case <-t.done:
+			t.flush(conn, peer)
+			return
+		}
+	}
+}
+
+// flush 關閉時送出還在排隊的訊息，例如節點離開的通知 (write what is still queued when closing, such as the node leave)
+func (t *TCP) flush(conn net.Conn, peer *tcpPeer) {
+	conn.SetWriteDeadline(time.Now().Add(t.config.RetryInterval))
+
+	for {
+		select {
+		case frame := <-peer.queue:
+			if writeFrame(conn, frame) != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// authenticate 讀取連入節點的問候，有 Secret 時要求它簽署隨機數 (read the hello of a node dialing in, and have it sign a nonce when a Secret is set)
+func (t *TCP) authenticate(conn net.Conn) (string, bool) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	hello, err := readMessage(conn, maxHandshakeSize)
+	if err != nil || hello.Kind != kindHello || hello.Node == "" {
+		return "", false
+	}
+
+	if len(t.config.Secret) > 0 {
+		nonce := make([]byte, nonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return "", false
+		}
+
+		if writeMessage(conn, &hail.BackplaneMessage{Kind: kindChallenge, Node: t.config.NodeID, Data: nonce}) != nil {
+			return "", false
+		}
+
+		auth, err := readMessage(conn, maxHandshakeSize)
+		if err != nil || auth.Kind != kindAuth || !hmac.Equal(auth.Data, t.sign(hello.Node, nonce)) {
+			return "", false
+		}
+	}
+
+	return hello.Node, conn.SetDeadline(time.Time{}) == nil
+}
+
+// handshake 送出問候，有 Secret 時簽署對方的隨機數 (send the hello, and sign the nonce of the peer when a Secret is set)
+func (t *TCP) handshake(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	if err := writeMessage(conn, &hail.BackplaneMessage{Kind: kindHello, Node: t.config.NodeID}); err != nil {
+		return err
+	}
+
+	if len(t.config.Secret) > 0 {
+		challenge, err := readMessage(conn, maxHandshakeSize)
+		if err != nil {
+			return err
+		}
+		if challenge.Kind != kindChallenge || len(challenge.Data) != nonceSize {
+			return errHandshake
+		}
+
+		err = writeMessage(conn, &hail.BackplaneMessage{Kind: kindAuth, Node: t.config.NodeID, Data: t.sign(t.config.NodeID, challenge.Data)})
+		if err != nil {
+			return err
+		}
+	}
+
+	return conn.SetDeadline(time.Time{})
+}
+
+func (t *TCP) sign(node string, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, t.config.Secret)
+	mac.Write([]byte(node + "\n"))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+func writeMessage(w io.Writer, msg *hail.BackplaneMessage) error {
+	frame, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return writeFrame(w, frame)
+}
+
+func writeFrame(w io.Writer, frame []byte) error {
+	if len(frame) > maxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	buf := make([]byte, 4+len(frame))
+	binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+	copy(buf[4:], frame)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// readMessage 讀取一個訊框，大於 limit 時不配置緩衝 (read one frame, nothing is allocated when it is larger than limit)
+func readMessage(r io.Reader, limit uint32) (*hail.BackplaneMessage, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > limit {
+		return nil, ErrFrameTooLarge
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+
+	msg := &hail.BackplaneMessage{}
+	if err := json.Unmarshal(frame, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,143 @@
+package backplane_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/backplane"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTCP(t *testing.T, node string, secret string, peers ...string) *backplane.TCP {
+	tcp, err := backplane.NewTCP(backplane.TCPConfig{
+		NodeID:        node,
+		ListenAddr:    "127.0.0.1:0",
+		Peers:         peers,
+		RetryInterval: 20 * time.Millisecond,
+		Secret:        []byte(secret),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+
+	tcp.Subscribe(func(*hail.BackplaneMessage) {}, func(string, bool) {})
+
+	return tcp
+}
+
+func TestTCPSecretRejectsUnknownNodes(t *testing.T) {
+	a := newTCP(t, "a", "secret")
+	newTCP(t, "b", "secret", a.Addr().String())
+	newTCP(t, "c", "wrong", a.Addr().String())
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !reflect.DeepEqual(a.Nodes(), []string{"b"}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("a sees %v, want [b]", a.Nodes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if nodes := a.Nodes(); !reflect.DeepEqual(nodes, []string{"b"}) {
+		t.Fatalf("a sees %v, want [b]", nodes)
+	}
+}
+
+func TestTCPCloseFlushesQueue(t *testing.T) {
+	received := make(chan *hail.BackplaneMessage, 1)
+	a, err := backplane.NewTCP(backplane.TCPConfig{NodeID: "a", ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.Subscribe(func(m *hail.BackplaneMessage) { received <- m }, func(string, bool) {})
+
+	b := newTCP(t, "b", "", a.Addr().String())
+	for len(a.Nodes()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b.Publish(&hail.BackplaneMessage{Kind: hail.BackplaneNodeLeave, Node: "b"})
+	b.Close()
+
+	select {
+	case m := <-received:
+		if m.Kind != hail.BackplaneNodeLeave {
+			t.Fatalf("got %s, want node_leave", m.Kind)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the queued message was lost on Close")
+	}
+}
+
+func TestTCPRejectsOversizedHello(t *testing.T) {
+	a := newTCP(t, "a", "secret")
+
+	conn, err := net.Dial("tcp", a.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 宣稱 64 MiB 的問候訊框 (a hello claiming to be 64 MiB)
+	conn.Write(binary.BigEndian.AppendUint32(nil, 64<<20))
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v, want the connection closed", err)
+	}
+}
+
+func TestTCPReplayedAuthIsRejected(t *testing.T) {
+	a := newTCP(t, "a", "secret")
+
+	// 重送另一次握手的 HMAC (replay the HMAC of another handshake)
+	conn, err := net.Dial("tcp", a.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	send := func(m *hail.BackplaneMessage) {
+		frame, _ := json.Marshal(m)
+		conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(frame))), frame...))
+	}
+	send(&hail.BackplaneMessage{Kind: "hello", Node: "b"})
+	send(&hail.BackplaneMessage{Kind: "auth", Node: "b", Data: make([]byte, 32)})
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	io.Copy(io.Discard, conn)
+
+	if nodes := a.Nodes(); len(nodes) != 0 {
+		t.Fatalf("a sees %v, want no node", nodes)
+	}
+}
+
+func TestTCPDropsFramesForOtherNodes(t *testing.T) {
+	received := make(chan *hail.BackplaneMessage, 2)
+	a, err := backplane.NewTCP(backplane.TCPConfig{NodeID: "a", ListenAddr: "127.0.0.1:0", Secret: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.Subscribe(func(m *hail.BackplaneMessage) { received <- m }, func(string, bool) {})
+
+	b := newTCP(t, "b", "secret", a.Addr().String())
+	b.Publish(&hail.BackplaneMessage{Kind: hail.BackplaneNodeLeave, Node: "c"})
+	b.Publish(&hail.BackplaneMessage{Kind: hail.BackplaneBroadcast, Node: "b"})
+
+	select {
+	case m := <-received:
+		if m.Node != "b" || m.Kind != hail.BackplaneBroadcast {
+			t.Fatalf("got %s from %s, want only the broadcast of b", m.Kind, m.Node)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the message of b was not received")
+	}
+}
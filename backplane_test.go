@@ -0,0 +1,175 @@
+package hail_test
+
+import (
+	"context"
+	"errors"
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/backplane"
+	"github.com/lishank0119/hail/hailtest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// unreachable 前 failures 次 Subscribe 失敗的 Backplane (a Backplane whose first failures Subscribe calls fail)
+type unreachable struct {
+	hail.Backplane
+	failures int32
+	calls    atomic.Int32
+}
+
+var errUnreachable = errors.New("broker unreachable")
+
+func (u *unreachable) Subscribe(onMessage func(*hail.BackplaneMessage), onNode func(string, bool)) error {
+	if u.calls.Add(1) <= u.failures {
+		return errUnreachable
+	}
+
+	return u.Backplane.Subscribe(onMessage, onNode)
+}
+
+func TestShutdownLeavesCluster(t *testing.T) {
+	network := backplane.NewNetwork()
+
+	a := hail.New(&hail.Option{Backplane: network.Join("a")})
+	presence := make(chan hail.PresenceEvent, 4)
+	a.HandlePresence(func(e hail.PresenceEvent) {
+		presence <- e
+	})
+	srvA := hailtest.NewServer(a)
+	defer srvA.Close()
+
+	b := hail.New(&hail.Option{Backplane: network.Join("b")})
+	srvB := hailtest.NewServer(b)
+	srvB.Dial(t)
+
+	expectPresence(t, presence, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), hailtest.DefaultTimeout)
+	defer cancel()
+	b.Shutdown(ctx)
+
+	expectPresence(t, presence, false)
+	if a.ClusterLen() != 0 || len(a.Nodes()) != 0 {
+		t.Fatalf("a still sees %d sessions on %v", a.ClusterLen(), a.Nodes())
+	}
+	srvB.Close()
+}
+
+func expectPresence(t *testing.T, presence <-chan hail.PresenceEvent, online bool) {
+	t.Helper()
+
+	select {
+	case e := <-presence:
+		if e.Node != "b" || e.Online != online {
+			t.Fatalf("got %+v, want online %v on b", e, online)
+		}
+	case <-time.After(hailtest.DefaultTimeout):
+		t.Fatalf("no presence event, want online %v", online)
+	}
+}
+
+func TestSubscribeFailureIsRetried(t *testing.T) {
+	clock := hailtest.NewClock()
+	bp := &unreachable{Backplane: backplane.NewNetwork().Join("a"), failures: 1}
+
+	h := hail.New(&hail.Option{Backplane: bp, Clock: clock})
+	defer hailtest.NewServer(h).Close()
+
+	if n := bp.calls.Load(); n != 1 {
+		t.Fatalf("Subscribe called %d times, want 1", n)
+	}
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if n := bp.calls.Load(); n != 2 {
+		t.Fatalf("Subscribe called %d times after the retry interval, want 2", n)
+	}
+
+	clock.Advance(time.Second)
+	if n := bp.calls.Load(); n != 2 {
+		t.Fatalf("Subscribe retried %d times after succeeding", n-2)
+	}
+}
+
+func TestOpenReturnsSubscribeError(t *testing.T) {
+	bp := &unreachable{Backplane: backplane.NewNetwork().Join("a"), failures: 1}
+
+	h, err := hail.Open(&hail.Option{Backplane: bp})
+	if h != nil || err != errUnreachable {
+		t.Fatalf("got %v, %v, want the Subscribe error", h, err)
+	}
+}
+
+// clusterNode 加入 network 的測試伺服器，連線時以 user 參數綁定使用者並回報 ID
+// (a test server joined to network, binding the user query parameter on connect and reporting the session ID)
+func clusterNode(t *testing.T, network *backplane.Network, node string) (*hailtest.Server, <-chan string) {
+	srv := newServer(t, &hail.Option{Backplane: network.Join(node)})
+
+	ids := make(chan string, 4)
+	srv.Hail.HandleConnect(func(s *hail.Session) {
+		if user := s.Request.URL.Query().Get("user"); user != "" {
+			s.BindUser(user)
+		}
+		ids <- s.GetHashID()
+	})
+
+	return srv, ids
+}
+
+// eventually 等待 cond 成立 (wait until cond holds)
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(hailtest.DefaultTimeout); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestBackplaneDeliversAcrossNodes(t *testing.T) {
+	network := backplane.NewNetwork()
+	a, _ := clusterNode(t, network, "a")
+	b, ids := clusterNode(t, network, "b")
+
+	isAlice := func(s *hail.Session) bool { return s.UserID() == "alice" }
+	a.Hail.RegisterFilter("alice", isAlice)
+	b.Hail.RegisterFilter("alice", isAlice)
+
+	alice := b.DialWith(t, "user=alice", nil)
+	bob := b.DialWith(t, "user=bob", nil)
+	id := <-ids
+	<-ids
+	subscribe(alice, "news")
+
+	eventually(t, "a to see alice", func() bool {
+		loc, ok := a.Hail.LocateSession(id)
+		return ok && loc.UserID == "alice"
+	})
+
+	if err := a.Hail.Broadcast([]byte("all")); err != nil {
+		t.Fatal(err)
+	}
+	hailtest.ExpectBroadcast(t, "all", alice, bob)
+
+	if err := a.Hail.BroadcastNamedFilter([]byte("filtered"), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	alice.Expect("filtered")
+
+	a.Hail.PubTextMsg([]byte("headline"), false, "news")
+	alice.Expect("headline")
+
+	if err := a.Hail.SendTo(id, []byte("direct")); err != nil {
+		t.Fatal(err)
+	}
+	alice.Expect("direct")
+
+	if err := a.Hail.SendToUser("alice", []byte("to alice")); err != nil {
+		t.Fatal(err)
+	}
+	alice.Expect("to alice")
+
+	bob.ExpectNothing(50 * time.Millisecond)
+}
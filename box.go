@@ -1,9 +1,14 @@
 package hail
 
-import "github.com/lesismal/nbio/nbhttp/websocket"
+import (
+	"github.com/lesismal/nbio/nbhttp/websocket"
+	"time"
+)
 
 type box struct {
-	t      websocket.MessageType
-	msg    []byte
-	filter filterFunc
+	t       websocket.MessageType
+	msg     []byte
+	filter  filterFunc
+	trace   SpanContext // 送出這則訊息的 span (the span that sent the message)
+	created time.Time   // 送出的時間，用來計算排隊時間 (when the message was sent, for the queue wait)
 }
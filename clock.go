@@ -0,0 +1,62 @@
+package hail
+
+import "time"
+
+// Clock tells the time and drives the timers of hail: the ping ticker of every session and
+// PongWait, ResumeGrace, the retention of topics and the token buckets of RateLimit. See Option.Clock.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	// AfterFunc calls f in its own goroutine once d has elapsed, like time.AfterFunc.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Ticker delivers ticks on C, like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer is a pending AfterFunc call, like time.Timer.
+type Timer interface {
+	// Stop prevents the call, it returns false when the call already happened or was stopped.
+	Stop() bool
+}
+
+// realClock 系統時間，是預設的 Clock (the system time, the default Clock)
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// seen 記錄最後一次收到客戶端訊息或 pong 的時間 (record when the client last sent a message or a pong)
+func (s *Session) seen() {
+	s.rwMutex.Lock()
+	s.lastSeen = s.hail.Option.Clock.Now()
+	s.rwMutex.Unlock()
+}
+
+// pongExpired 超過 PongWait 沒有收到客戶端任何訊息 (nothing was read from the client for longer than PongWait)
+func (s *Session) pongExpired() bool {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	return s.hail.Option.Clock.Now().Sub(s.lastSeen) > s.hail.Option.PongWait
+}
@@ -0,0 +1,66 @@
+package hail
+
+import (
+	"encoding/binary"
+	"github.com/lesismal/nbio/nbhttp/websocket"
+)
+
+// Close codes defined in RFC 6455, section 7.4.1.
+// Applications may use the 4000-4999 range for their own codes.
+const (
+	CloseNormalClosure   = 1000 // 正常關閉 (normal closure)
+	CloseGoingAway       = 1001 // 伺服器關機或離開 (the endpoint is going away, such as a server shutdown)
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008 // 違反政策，例如被踢除 (policy violation, such as a kick)
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+	CloseServiceRestart  = 1012 // 伺服器重啟 (the server is restarting)
+	CloseTryAgainLater   = 1013
+	CloseBadGateway      = 1014 // 閘道收到上游的錯誤回應 (a gateway received an invalid response from upstream)
+
+	// CloseNoStatusReceived 收到的 close frame 沒有 code，不可送出 (a close frame without a code was received, never sent)
+	CloseNoStatusReceived = 1005
+)
+
+const (
+	maxCloseReasonLength  = 123
+	minApplicationCode    = 3000
+	maxApplicationCode    = 4999
+	closeCodeLengthInByte = 2
+)
+
+// validCloseCode 判斷是否可由伺服器送出的 close code (whether code may be sent in a close frame)
+// 1010 (mandatory extension) is only sent by clients.
+func validCloseCode(code int) bool {
+	switch code {
+	case CloseNormalClosure, CloseGoingAway, CloseProtocolError, CloseUnsupportedData,
+		CloseInvalidPayload, ClosePolicyViolation, CloseMessageTooBig,
+		CloseInternalError, CloseServiceRestart, CloseTryAgainLater, CloseBadGateway:
+		return true
+	}
+
+	return code >= minApplicationCode && code <= maxApplicationCode
+}
+
+// newCloseBox 組出 close frame，code 或 reason 不合法時回傳錯誤 (build a close frame, fails on an invalid code or reason)
+func newCloseBox(code int, reason string) (*box, error) {
+	if !validCloseCode(code) {
+		return nil, ErrInvalidCloseCode
+	}
+
+	if len(reason) > maxCloseReasonLength {
+		return nil, ErrCloseReasonTooLong
+	}
+
+	return &box{t: websocket.CloseMessage, msg: closeMessage(code, reason)}, nil
+}
+
+// closeMessage 組出 close frame 的內容 (build the payload of a close frame)
+func closeMessage(code int, reason string) []byte {
+	buf := make([]byte, closeCodeLengthInByte+len(reason))
+	binary.BigEndian.PutUint16(buf, uint16(code))
+	copy(buf[closeCodeLengthInByte:], reason)
+	return buf
+}
@@ -0,0 +1,38 @@
+package hail_test
+
+import (
+	"github.com/lishank0119/hail"
+	"strings"
+	"testing"
+)
+
+func TestCloseWithReason(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+	h := srv.Hail
+	ids := connectID(h)
+
+	disconnected := make(chan hail.DisconnectInfo, 1)
+	h.HandleDisconnectInfo(func(s *hail.Session, info hail.DisconnectInfo) {
+		disconnected <- info
+	})
+
+	c := srv.Dial(t)
+	s, _ := h.Session(<-ids)
+
+	if err := s.CloseWithReason(hail.CloseNoStatusReceived, ""); err != hail.ErrInvalidCloseCode {
+		t.Fatalf("got %v, want ErrInvalidCloseCode", err)
+	}
+	if err := s.CloseWithReason(4000, strings.Repeat("x", 124)); err != hail.ErrCloseReasonTooLong {
+		t.Fatalf("got %v, want ErrCloseReasonTooLong", err)
+	}
+
+	if err := s.CloseWithReason(4000, "bye"); err != nil {
+		t.Fatal(err)
+	}
+	c.ExpectClose(4000)
+
+	info := <-disconnected
+	if info.Cause != hail.DisconnectServer || info.Code != 4000 || info.Reason != "bye" {
+		t.Fatalf("got %+v, want a server close with 4000 bye", info)
+	}
+}
@@ -0,0 +1,138 @@
+package hail
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"github.com/lesismal/nbio/nbhttp/websocket"
+)
+
+// MessageType is the websocket message type a Codec sends its values as.
+type MessageType = websocket.MessageType
+
+const (
+	TextMessage   = websocket.TextMessage
+	BinaryMessage = websocket.BinaryMessage
+)
+
+// Codec encodes the values of WriteValue and BroadcastValue, and decodes the messages of HandleTyped.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	// MessageType returns the message type values are sent as, and the one HandleTyped handles.
+	MessageType() MessageType
+}
+
+var (
+	// JSONCodec encodes values as JSON text messages, it is the default Option.Codec.
+	JSONCodec Codec = jsonCodec{}
+	// GobCodec encodes values with encoding/gob as binary messages.
+	GobCodec Codec = gobCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) MessageType() MessageType {
+	return TextMessage
+}
+
+// gobCodec 每則訊息獨立編碼，包含型別資訊 (every message is encoded on its own, with its type information)
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (gobCodec) MessageType() MessageType {
+	return BinaryMessage
+}
+
+// HandleTyped decodes the messages of the Option.Codec message type into a T and fires fn with it.
+// It replaces HandleMessage, or HandleMessageBinary for a binary codec. Decoding errors go to HandleError.
+func HandleTyped[T any](h *Hail, fn func(*Session, T)) {
+	codec := h.Option.Codec
+
+	handler := func(s *Session, msg []byte) {
+		var v T
+		if err := codec.Unmarshal(msg, &v); err != nil {
+			h.errorHandler(s, err)
+			return
+		}
+
+		fn(s, v)
+	}
+
+	if codec.MessageType() == BinaryMessage {
+		h.HandleMessageBinary(handler)
+	} else {
+		h.HandleMessage(handler)
+	}
+}
+
+// encode 以 Option.Codec 編碼，有 Session 時錯誤也交給 HandleError，廣播時只回傳給呼叫端
+// (encode with Option.Codec, errors also go to HandleError for a session, a broadcast only returns them)
+func (h *Hail) encode(s *Session, v interface{}) (*box, error) {
+	msg, err := h.Option.Codec.Marshal(v)
+	if err != nil {
+		if s != nil {
+			h.errorHandler(s, err)
+		}
+		return nil, err
+	}
+
+	return &box{t: h.Option.Codec.MessageType(), msg: msg}, nil
+}
+
+// WriteValue encodes v with Option.Codec and writes it to the session.
+func (s *Session) WriteValue(v interface{}) error {
+	if s.closed() {
+		return ErrWriteCloseSession
+	}
+
+	message, err := s.hail.encode(s, v)
+	if err != nil {
+		return err
+	}
+
+	return s.writeMessage(message)
+}
+
+// BroadcastValue encodes v with Option.Codec and broadcasts it to all sessions.
+func (h *Hail) BroadcastValue(v interface{}) error {
+	if h.hub.closed() {
+		return ErrClose
+	}
+
+	message, err := h.encode(nil, v)
+	if err != nil {
+		return err
+	}
+
+	span := h.startMessage("hail.broadcast", message, nil)
+	defer span.End()
+
+	if !h.hub.send(h.hub.broadcast, message) {
+		return ErrClose
+	}
+
+	h.forward(&BackplaneMessage{Kind: BackplaneBroadcast}, message)
+
+	return nil
+}
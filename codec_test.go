@@ -0,0 +1,83 @@
+package hail_test
+
+import (
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/hailtest"
+	"testing"
+	"time"
+)
+
+type point struct {
+	X, Y int
+}
+
+func TestBroadcastValueErrorGoesToCaller(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+	h := srv.Hail
+
+	handled := make(chan *hail.Session, 1)
+	h.HandleError(func(s *hail.Session, err error) {
+		handled <- s
+	})
+
+	c := srv.Dial(t)
+	if err := h.BroadcastValue(make(chan int)); err == nil {
+		t.Fatal("encoding a channel succeeded")
+	}
+
+	select {
+	case s := <-handled:
+		t.Fatalf("HandleError fired for session %v", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := h.BroadcastValue(map[string]int{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	c.Expect(`{"n":1}`)
+}
+
+func TestHandleTypedJSON(t *testing.T) {
+	h := hail.New(&hail.Option{})
+	hail.HandleTyped(h, func(s *hail.Session, p point) {
+		s.WriteValue(point{X: p.Y, Y: p.X})
+	})
+
+	srv := hailtest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	c := srv.Dial(t)
+	c.Send(`{"X":1,"Y":2}`)
+	c.Expect(`{"X":2,"Y":1}`)
+}
+
+func TestHandleTypedGob(t *testing.T) {
+	h := hail.New(&hail.Option{Codec: hail.GobCodec})
+	hail.HandleTyped(h, func(s *hail.Session, p point) {
+		s.WriteValue(point{X: p.X * 10, Y: p.Y * 10})
+	})
+
+	srv := hailtest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	data, err := hail.GobCodec.Marshal(point{X: 1, Y: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := srv.Dial(t)
+	c.SendBinary(data)
+
+	m := c.Next(hailtest.DefaultTimeout)
+	if m.Type != hail.BinaryMessage {
+		t.Fatalf("got message type %v, want binary", m.Type)
+	}
+
+	var got point
+	if err := hail.GobCodec.Unmarshal(m.Data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != (point{X: 10, Y: 20}) {
+		t.Fatalf("got %+v", got)
+	}
+}
@@ -0,0 +1,267 @@
+package hail
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+const (
+	BackplaneSessionJoin   BackplaneKind = "session_join"   // a session registered, Target is its hashID
+	BackplaneSessionLeave  BackplaneKind = "session_leave"  // a session unregistered, Target is its hashID
+	BackplaneDirectorySync BackplaneKind = "directory_sync" // Data holds every session of the sending node
+)
+
+// SessionLocation tells which node holds a session.
+type SessionLocation struct {
+	SessionID string `json:"session"`
+	UserID    string `json:"user,omitempty"`
+	Node      string `json:"node"`
+}
+
+// PresenceEvent is fired when a session connects or disconnects on any node of the cluster.
+type PresenceEvent struct {
+	SessionLocation
+	Online bool
+}
+
+type handlePresenceFunc func(PresenceEvent)
+
+// directory 其他節點的Session (the sessions held by the other nodes)
+type directory struct {
+	rwMutex  sync.RWMutex
+	sessions map[string]SessionLocation // Key: hashID
+	nodes    map[string]map[string]bool // Key: node, Value: 此節點的hashID
+}
+
+func newDirectory() *directory {
+	return &directory{
+		sessions: make(map[string]SessionLocation),
+		nodes:    make(map[string]map[string]bool),
+	}
+}
+
+// add 回傳是否要通知上線：新的Session、換了節點，或第一次綁定使用者
+// (returns whether to announce the session online: it is new, moved to another node or got its first user)
+func (d *directory) add(loc SessionLocation) bool {
+	d.rwMutex.Lock()
+	defer d.rwMutex.Unlock()
+
+	old, exists := d.sessions[loc.SessionID]
+	if exists && old.Node != loc.Node {
+		delete(d.nodes[old.Node], loc.SessionID)
+	}
+
+	d.sessions[loc.SessionID] = loc
+	if d.nodes[loc.Node] == nil {
+		d.nodes[loc.Node] = make(map[string]bool)
+	}
+	d.nodes[loc.Node][loc.SessionID] = true
+
+	return !exists || old.Node != loc.Node || (old.UserID == "" && loc.UserID != "")
+}
+
+// remove 只移除仍屬於 node 的Session (remove the session only while node still holds it)
+func (d *directory) remove(node, hashID string) (SessionLocation, bool) {
+	d.rwMutex.Lock()
+	defer d.rwMutex.Unlock()
+
+	loc, ok := d.sessions[hashID]
+	if !ok || loc.Node != node {
+		return loc, false
+	}
+
+	delete(d.sessions, hashID)
+	delete(d.nodes[node], hashID)
+	if len(d.nodes[node]) == 0 {
+		delete(d.nodes, node)
+	}
+
+	return loc, true
+}
+
+// removeNode 移除離開的節點的所有Session (remove every session of a node that left)
+func (d *directory) removeNode(node string) []SessionLocation {
+	d.rwMutex.Lock()
+	defer d.rwMutex.Unlock()
+
+	removed := make([]SessionLocation, 0, len(d.nodes[node]))
+	for hashID := range d.nodes[node] {
+		removed = append(removed, d.sessions[hashID])
+		delete(d.sessions, hashID)
+	}
+	delete(d.nodes, node)
+
+	return removed
+}
+
+func (d *directory) get(hashID string) (SessionLocation, bool) {
+	d.rwMutex.RLock()
+	defer d.rwMutex.RUnlock()
+
+	loc, ok := d.sessions[hashID]
+	return loc, ok
+}
+
+func (d *directory) len() int {
+	d.rwMutex.RLock()
+	defer d.rwMutex.RUnlock()
+
+	return len(d.sessions)
+}
+
+func (d *directory) user(userID string) []SessionLocation {
+	d.rwMutex.RLock()
+	defer d.rwMutex.RUnlock()
+
+	var locations []SessionLocation
+	for _, loc := range d.sessions {
+		if loc.UserID == userID {
+			locations = append(locations, loc)
+		}
+	}
+
+	return locations
+}
+
+// HandlePresence fires fn when a session connects or disconnects on any node of the cluster.
+func (h *Hail) HandlePresence(fn func(PresenceEvent)) {
+	h.presenceHandler = fn
+}
+
+// ClusterLen returns the number of sessions connected to every node of the cluster.
+func (h *Hail) ClusterLen() int {
+	return h.hub.len() + h.directory.len()
+}
+
+// LocateSession returns where the session identified by hashID is connected.
+func (h *Hail) LocateSession(hashID string) (SessionLocation, bool) {
+	if s, ok := h.hub.get(hashID); ok {
+		return h.location(s), true
+	}
+
+	return h.directory.get(hashID)
+}
+
+// LocateUser returns where the sessions bound to userID are connected, across the cluster.
+func (h *Hail) LocateUser(userID string) []SessionLocation {
+	locations := h.directory.user(userID)
+	for _, s := range h.hub.userSessions(userID) {
+		locations = append(locations, h.location(s))
+	}
+
+	return locations
+}
+
+func (h *Hail) nodeID() string {
+	if h.Option.Backplane == nil {
+		return ""
+	}
+
+	return h.Option.Backplane.NodeID()
+}
+
+func (h *Hail) location(s *Session) SessionLocation {
+	return SessionLocation{SessionID: s.hashID, UserID: s.UserID(), Node: h.nodeID()}
+}
+
+// sessionJoined 通知其他節點與 HandlePresence 有新的Session (announce a registered session to the other nodes and HandlePresence)
+func (h *Hail) sessionJoined(s *Session) {
+	loc := h.location(s)
+	h.announce(BackplaneSessionJoin, loc)
+	h.presenceHandler(PresenceEvent{SessionLocation: loc, Online: true})
+}
+
+// userBound 通知其他節點Session的新使用者，只有第一次綁定才觸發 HandlePresence
+// (tell the other nodes the new user of a session, HandlePresence only fires for the first bind)
+func (h *Hail) userBound(s *Session, previous string) {
+	loc := h.location(s)
+	h.announce(BackplaneSessionJoin, loc)
+	if previous == "" && loc.UserID != "" {
+		h.presenceHandler(PresenceEvent{SessionLocation: loc, Online: true})
+	}
+}
+
+// sessionLeft 通知其他節點與 HandlePresence Session已離開 (announce an unregistered session to the other nodes and HandlePresence)
+func (h *Hail) sessionLeft(s *Session) {
+	loc := h.location(s)
+	h.announce(BackplaneSessionLeave, loc)
+	h.presenceHandler(PresenceEvent{SessionLocation: loc, Online: false})
+}
+
+func (h *Hail) announce(kind BackplaneKind, loc SessionLocation) {
+	if h.Option.Backplane == nil {
+		return
+	}
+
+	err := h.Option.Backplane.Publish(&BackplaneMessage{Kind: kind, Node: loc.Node, Target: loc.SessionID, User: loc.UserID})
+	if err != nil {
+		h.backplaneError(err)
+	}
+}
+
+// syncDirectory 將本地所有Session送給其他節點，在有節點加入時呼叫 (send every local session to the other nodes, called when a node joins)
+func (h *Hail) syncDirectory() {
+	sessions := h.hub.list()
+	locations := make([]SessionLocation, 0, len(sessions))
+	for _, s := range sessions {
+		locations = append(locations, h.location(s))
+	}
+
+	data, err := json.Marshal(locations)
+	if err != nil {
+		h.backplaneError(err)
+		return
+	}
+
+	if err = h.Option.Backplane.Publish(&BackplaneMessage{Kind: BackplaneDirectorySync, Node: h.nodeID(), Data: data}); err != nil {
+		h.backplaneError(err)
+	}
+}
+
+// receiveDirectory 處理其他節點的Session異動 (handle the session changes of another node)
+func (h *Hail) receiveDirectory(m *BackplaneMessage) {
+	switch m.Kind {
+	case BackplaneSessionJoin:
+		loc := SessionLocation{SessionID: m.Target, UserID: m.User, Node: m.Node}
+		if h.directory.add(loc) {
+			h.presenceHandler(PresenceEvent{SessionLocation: loc, Online: true})
+		}
+
+	case BackplaneSessionLeave:
+		if loc, ok := h.directory.remove(m.Node, m.Target); ok {
+			h.presenceHandler(PresenceEvent{SessionLocation: loc, Online: false})
+		}
+
+	case BackplaneDirectorySync:
+		var locations []SessionLocation
+		if err := json.Unmarshal(m.Data, &locations); err != nil {
+			h.backplaneError(err)
+			return
+		}
+
+		for _, loc := range locations {
+			loc.Node = m.Node
+			if h.directory.add(loc) {
+				h.presenceHandler(PresenceEvent{SessionLocation: loc, Online: true})
+			}
+		}
+	}
+}
+
+// nodeChanged 有節點加入時同步目錄，離開時移除它的Session (sync the directory when a node joins, drop its sessions when it leaves)
+func (h *Hail) nodeChanged(node string, up bool) {
+	if up {
+		h.syncDirectory()
+	} else {
+		h.nodeLeft(node)
+	}
+
+	h.nodeHandler(node, up)
+}
+
+// nodeLeft 移除節點的所有Session，重複呼叫不會重複通知 (drop every session of node, calling it again announces nothing)
+func (h *Hail) nodeLeft(node string) {
+	for _, loc := range h.directory.removeNode(node) {
+		h.presenceHandler(PresenceEvent{SessionLocation: loc, Online: false})
+	}
+}
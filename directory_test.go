@@ -0,0 +1,47 @@
+package hail_test
+
+import (
+	"github.com/lishank0119/hail/backplane"
+	"sort"
+	"testing"
+)
+
+func TestLocateAcrossNodes(t *testing.T) {
+	network := backplane.NewNetwork()
+	a, idsA := clusterNode(t, network, "a")
+	b, idsB := clusterNode(t, network, "b")
+
+	local := a.DialWith(t, "user=alice", nil)
+	localID := <-idsA
+	remote := b.DialWith(t, "user=alice", nil)
+	remoteID := <-idsB
+
+	eventually(t, "a to see the session on b", func() bool {
+		loc, ok := a.Hail.LocateSession(remoteID)
+		return ok && loc.UserID == "alice"
+	})
+
+	if loc, _ := a.Hail.LocateSession(remoteID); loc.Node != "b" {
+		t.Fatalf("remote session located on %q, want b", loc.Node)
+	}
+	if loc, ok := a.Hail.LocateSession(localID); !ok || loc.Node != "a" {
+		t.Fatalf("local session located on %q, %v, want a", loc.Node, ok)
+	}
+
+	var nodes []string
+	for _, loc := range a.Hail.LocateUser("alice") {
+		nodes = append(nodes, loc.Node)
+	}
+	sort.Strings(nodes)
+	if len(nodes) != 2 || nodes[0] != "a" || nodes[1] != "b" {
+		t.Fatalf("alice located on %v, want [a b]", nodes)
+	}
+
+	remote.Drop()
+	eventually(t, "a to forget the closed session", func() bool {
+		_, ok := a.Hail.LocateSession(remoteID)
+		return !ok && len(a.Hail.LocateUser("alice")) == 1
+	})
+	local.Send("still here")
+	local.Expect("still here")
+}
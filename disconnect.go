@@ -0,0 +1,117 @@
+package hail
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/lesismal/nbio/nbhttp/websocket"
+	"net"
+	"time"
+)
+
+// DisconnectCause 斷線原因 (who or what closed the connection)
+type DisconnectCause int
+
+const (
+	// DisconnectNetwork 連線中斷，沒有收到 close frame (the connection dropped without a close frame)
+	DisconnectNetwork DisconnectCause = iota
+	// DisconnectClient 客戶端送出 close frame (the client sent a close frame)
+	DisconnectClient
+	// DisconnectServer 伺服器主動關閉，例如踢除 (the server closed the session, such as a kick)
+	DisconnectServer
+	// DisconnectPongTimeout 在 PongWait 內沒有收到任何資料 (nothing was read within PongWait)
+	DisconnectPongTimeout
+	// DisconnectWriteError 寫入失敗 (writing to the connection failed)
+	DisconnectWriteError
+	// DisconnectBufferOverflow 輸出緩衝區已滿 (the session could not keep up with its output buffer)
+	DisconnectBufferOverflow
+	// DisconnectShutdown 伺服器關機 (the Hail instance was shut down)
+	DisconnectShutdown
+)
+
+func (c DisconnectCause) String() string {
+	switch c {
+	case DisconnectNetwork:
+		return "network"
+	case DisconnectClient:
+		return "client"
+	case DisconnectServer:
+		return "server"
+	case DisconnectPongTimeout:
+		return "pong_timeout"
+	case DisconnectWriteError:
+		return "write_error"
+	case DisconnectBufferOverflow:
+		return "buffer_overflow"
+	case DisconnectShutdown:
+		return "shutdown"
+	}
+
+	return "unknown"
+}
+
+// DisconnectInfo describes why a session was disconnected.
+type DisconnectInfo struct {
+	Cause    DisconnectCause
+	Code     int           // close code sent or received, 0 when no close frame was involved
+	Reason   string        // close reason sent or received
+	Err      error         // error reported by the connection, if any
+	Duration time.Duration // how long the session was connected
+	Parked   bool          // the session waits up to Option.ResumeGrace to be resumed
+}
+
+// setDisconnect 記錄斷線原因，只保留第一次的原因 (record why the session is closing, the first cause wins)
+func (s *Session) setDisconnect(cause DisconnectCause, message *box, err error) {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	if s.disconnectSet {
+		return
+	}
+
+	s.disconnectSet = true
+	s.disconnect.Cause = cause
+	s.disconnect.Err = err
+
+	if message != nil && message.t == websocket.CloseMessage && len(message.msg) >= closeCodeLengthInByte {
+		s.disconnect.Code = int(binary.BigEndian.Uint16(message.msg))
+		s.disconnect.Reason = string(message.msg[closeCodeLengthInByte:])
+	}
+}
+
+// disconnectInfo 回傳斷線資訊，未記錄原因時依 err 推斷 (return the disconnect info, inferring the cause from err when none was recorded)
+func (s *Session) disconnectInfo(err error) DisconnectInfo {
+	if isTimeout(err) {
+		s.setDisconnect(DisconnectPongTimeout, nil, err)
+	} else {
+		s.setDisconnect(DisconnectNetwork, nil, err)
+	}
+
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	info := s.disconnect
+	info.Duration = s.hail.Option.Clock.Now().Sub(s.connectedAt)
+
+	return info
+}
+
+func (s *Session) disconnectRecorded() bool {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	return s.disconnectSet
+}
+
+func isTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	// nbio 的 poller 以此訊息回報讀取逾時 (nbio pollers report read deadlines with this message)
+	return err.Error() == "read timeout"
+}
@@ -0,0 +1,28 @@
+package hail_test
+
+import (
+	"github.com/lishank0119/hail"
+	"testing"
+)
+
+func TestDisconnectCause(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+
+	disconnected := make(chan hail.DisconnectInfo, 1)
+	srv.Hail.HandleDisconnectInfo(func(s *hail.Session, info hail.DisconnectInfo) {
+		disconnected <- info
+	})
+
+	c := srv.Dial(t)
+	c.Send("hi")
+	c.Expect("hi")
+	c.Close()
+
+	info := <-disconnected
+	if info.Cause != hail.DisconnectClient || info.Code != hail.CloseNormalClosure {
+		t.Fatalf("got %+v, want a client close with 1000", info)
+	}
+	if info.Duration <= 0 {
+		t.Fatalf("got duration %s", info.Duration)
+	}
+}
@@ -9,4 +9,17 @@ var (
 	ErrHubClose                    = errors.New("hail hub is closed")
 	ErrClose                       = errors.New("hail instance is closed")
 	ErrWriteClosed                 = errors.New("tried to write to closed a session")
+	ErrSessionNotFound             = errors.New("session not found")
+	ErrInvalidCloseCode            = errors.New("invalid close code")
+	ErrCloseReasonTooLong          = errors.New("close reason is longer than 123 bytes")
+	ErrPublishTimeout              = errors.New("publish timed out")
+	ErrInvalidTopic                = errors.New("invalid topic")
+	ErrFilterNotFound              = errors.New("filter not registered")
+	ErrUnknownEvent                = errors.New("unknown event")
+	ErrRequestCanceled             = errors.New("request canceled, session closed")
+	ErrMissingToken                = errors.New("missing token")
+	ErrInvalidToken                = errors.New("invalid token")
+	ErrTokenExpired                = errors.New("token expired")
+	ErrEmptySecret                 = errors.New("empty HMAC secret")
+	ErrTooManySessions             = errors.New("too many sessions")
 )
@@ -93,6 +93,7 @@ func main() {
 	<-interrupt
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
+	h.Shutdown(ctx)
 	svr.Shutdown(ctx)
 }
 
@@ -80,6 +80,7 @@ func main() {
 	<-interrupt
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
+	h.Shutdown(ctx)
 	svr.Shutdown(ctx)
 }
 
@@ -1,16 +1,21 @@
 package hail
 
 import (
+	"context"
 	"github.com/google/uuid"
 	"github.com/lesismal/nbio/nbhttp/websocket"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 )
 
 type handleMessageFunc func(*Session, []byte)
 type handleErrorFunc func(*Session, error)
 type handleCloseFunc func(*Session, int, string)
 type handleSessionFunc func(*Session)
+type handleDisconnectFunc func(*Session, DisconnectInfo)
+type handleDroppedFunc func(*Session, []byte)
 type filterFunc func(*Session) bool
 
 type Hail struct {
@@ -23,19 +28,66 @@ type Hail struct {
 	closeHandler             handleCloseFunc
 	connectHandler           handleSessionFunc
 	disconnectHandler        handleSessionFunc
+	disconnectInfoHandler    handleDisconnectFunc
 	pongHandler              handleSessionFunc
+	droppedHandler           handleDroppedFunc
 	hub                      *hub
 	pubSub                   *pubSub
+	sessionWG                sync.WaitGroup // 追蹤每個 session 的 run goroutine (tracks every session run goroutine)
+	sessionMutex             sync.Mutex     // 讓 sessionWG.Add 不與 Wait 同時發生 (keeps sessionWG.Add from racing with Wait)
+	shuttingDown             bool           // 由 sessionMutex 保護 (guarded by sessionMutex)
+	resumeMutex              sync.Mutex
+	parkedSessions           map[string]*Session // Key: resume token
+	nodeHandler              handleNodeFunc
+	backplaneErrorHandler    func(error)
+	presenceHandler          handlePresenceFunc
+	topicPresenceHandler     handleTopicPresenceFunc
+	filters                  *filters
+	directory                *directory
+	router                   *router
+	inbound                  Middleware
+	outbound                 Middleware
+	inboundHandler           Handler // 組合好的 inbound middleware，預設為 dispatch (the composed inbound chain, dispatch by default)
+	outboundHandler          Handler // 組合好的 outbound middleware，沒有時為nil (the composed outbound chain, nil without middlewares)
+	admission                *admission
+	observers                *observers
 }
 
+// New creates a Hail. When Option.Backplane fails to subscribe, the error goes to
+// HandleBackplaneError and Subscribe is retried every second; use Open to get the error instead.
 func New(o *Option) *Hail {
+	h := newHail(o)
+
+	if o.Backplane != nil {
+		h.subscribeBackplane()
+	}
+
+	return h
+}
+
+// Open creates a Hail like New, but returns the error of Option.Backplane.Subscribe instead of retrying it.
+func Open(o *Option) (*Hail, error) {
+	h := newHail(o)
+
+	if o.Backplane != nil {
+		if err := o.Backplane.Subscribe(h.receive, h.nodeChanged); err != nil {
+			h.hub.send(h.hub.exit, &box{t: websocket.CloseMessage, msg: closeMessage(CloseGoingAway, "")})
+			h.pubSub.Shutdown()
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+func newHail(o *Option) *Hail {
 	o.reset()
 
 	hub := newHub(o)
 
 	go hub.run()
 
-	return &Hail{
+	h := &Hail{
 		Option:                   o,
 		messageHandler:           func(*Session, []byte) {},
 		messageHandlerBinary:     func(*Session, []byte) {},
@@ -45,11 +97,29 @@ func New(o *Option) *Hail {
 		closeHandler:             nil,
 		connectHandler:           func(*Session) {},
 		disconnectHandler:        func(*Session) {},
+		disconnectInfoHandler:    func(*Session, DisconnectInfo) {},
 		pongHandler:              func(*Session) {},
+		droppedHandler:           func(*Session, []byte) {},
 		hub:                      hub,
-		pubSub:                   pubSubNew(o.ChannelBufferSize),
+		parkedSessions:           make(map[string]*Session),
+		nodeHandler:              func(string, bool) {},
+		backplaneErrorHandler:    func(error) {},
+		presenceHandler:          func(PresenceEvent) {},
+		filters:                  &filters{fns: make(map[string]filterFunc)},
+		directory:                newDirectory(),
+		admission:                newAdmission(o),
+		observers:                hub.observers,
+		topicPresenceHandler:     func(*Session, string, bool) {},
+		router:                   newRouter(),
 	}
 
+	h.inboundHandler = h.dispatch
+
+	h.pubSub = pubSubNew(o.Logger, o.Clock, func(change topicChange) {
+		h.topicPresenceHandler(change.s, change.topic, change.joined)
+	})
+
+	return h
 }
 
 // HandleConnect fires fn when a session connects.
@@ -62,12 +132,23 @@ func (h *Hail) HandleDisconnect(fn func(*Session)) {
 	h.disconnectHandler = fn
 }
 
+// HandleDisconnectInfo fires fn when a session disconnects, with the cause of the disconnection.
+func (h *Hail) HandleDisconnectInfo(fn func(*Session, DisconnectInfo)) {
+	h.disconnectInfoHandler = fn
+}
+
 // HandlePong fires fn when a pong is received from a session.
 func (h *Hail) HandlePong(fn func(*Session)) {
 	h.pongHandler = fn
 }
 
-// HandleMessage fires fn when a text message comes in.
+// HandleDropped fires fn with the payload of every message dropped by the SlowConsumerPolicy.
+func (h *Hail) HandleDropped(fn func(*Session, []byte)) {
+	h.droppedHandler = fn
+}
+
+// HandleMessage fires fn when a text message comes in. The messages of a session are handled
+// one at a time, in order, on a goroutine of the session apart from the one reading the connection.
 func (h *Hail) HandleMessage(fn func(*Session, []byte)) {
 	h.messageHandler = fn
 }
@@ -99,54 +180,172 @@ func (h *Hail) HandleClose(fn func(*Session, int, string)) {
 }
 
 func (h *Hail) AddConnect(w http.ResponseWriter, r *http.Request, keys map[string]interface{}) error {
-	if h.hub.closed() {
+	if !h.track() {
 		return ErrHubClose
 	}
+	running := false
+	defer func() {
+		if !running {
+			h.sessionWG.Done()
+		}
+	}()
+
+	var identity Identity
+	if h.Option.Authenticate != nil {
+		var authKeys map[string]interface{}
+		var err error
+		identity, authKeys, err = h.Option.Authenticate(r)
+		if err != nil {
+			h.reject(w, r, err)
+			return err
+		}
+
+		// 複製一份，不修改呼叫端的 map (merge into a copy, the map of the caller is left untouched)
+		if len(authKeys) > 0 {
+			merged := make(map[string]interface{}, len(keys)+len(authKeys))
+			for k, v := range keys {
+				merged[k] = v
+			}
+			for k, v := range authKeys {
+				merged[k] = v
+			}
+			keys = merged
+		}
+	}
+
+	ticket, err := h.acquire(r, identity)
+	if err != nil {
+		h.reject(w, r, err)
+		return err
+	}
 
 	session := &Session{
-		Request:    r,
-		Keys:       keys,
-		output:     make(chan *box, h.Option.ChannelBufferSize),
-		outputDone: make(chan struct{}), // fix write to close output channel
-		hail:       h,
-		open:       true,
-		rwMutex:    &sync.RWMutex{},
-		keyMutex:   &sync.RWMutex{},
-		hashID:     uuid.NewString(),
-		subChan:    h.pubSub.Sub("default"),
-	}
-
-	err := session.start(w, r)
+		Request:     r,
+		Keys:        keys,
+		output:      make(chan *box, h.Option.ChannelBufferSize),
+		outputDone:  make(chan struct{}), // fix write to close output channel
+		queueMutex:  &sync.Mutex{},
+		space:       make(chan struct{}, 1),
+		backlog:     &backlog{},
+		hail:        h,
+		open:        true,
+		rwMutex:     &sync.RWMutex{},
+		keyMutex:    &sync.RWMutex{},
+		hashID:      uuid.NewString(),
+		connectedAt: h.Option.Clock.Now(),
+		resumeToken: uuid.NewString(),
+		requests:    newRequests(),
+		identity:    identity,
+		userID:      identity.UserID,
+		limiter:     newRateLimiter(h.Option.RateLimit, h.Option.Clock),
+		delayed:     &delayed{},
+		inbox:       make(chan inbound, inboxSize),
+		handled:     make(chan struct{}),
+		ticket:      ticket,
+		lastSeen:    h.Option.Clock.Now(),
+	}
+
+	var parked *Session
+	if h.Option.ResumeGrace > 0 {
+		parked = h.takeParked(r, identity.UserID)
+		if parked != nil {
+			session.restore(parked)
+		}
+		w.Header().Set(h.Option.ResumeHeader, session.resumeToken)
+	}
+	session.logger = session.newLogger()
+	h.attach(ticket, session)
+
+	// 在回應升級之前建立，客戶端連上時 ticker 已經存在 (created before answering the upgrade, so the ticker exists once the client is connected)
+	session.ticker = h.Option.Clock.NewTicker(h.Option.PingPeriod)
+
+	err = session.start(w, r)
 	if err != nil {
+		session.logger.Warn("upgrade failed", "error", err)
+		session.ticker.Stop()
+		h.release(ticket)
+		if parked != nil {
+			h.repark(parked)
+		}
 		return err
 	}
 
-	h.hub.register <- session
+	select {
+	case h.hub.register <- session:
+	case <-h.hub.done:
+		session.ticker.Stop()
+		session.Close()
+		if parked != nil {
+			h.repark(parked)
+		}
+		return ErrHubClose
+	}
+
+	h.observers.sessionConnected(session)
+	h.sessionJoined(session)
+	session.logger.Debug("session connected", "resumed", parked != nil)
+
+	if parked != nil {
+		h.resume(parked, session)
+	}
+
+	h.pubSub.AddSub(session, defaultTopic)
 
-	go session.run()
+	running = true
+	go func() {
+		defer h.sessionWG.Done()
+		session.run()
+	}()
 
 	return nil
 }
 
+// track 登記一個新的 session goroutine，關機後回傳false (count a new session goroutine, returns false once shutting down)
+func (h *Hail) track() bool {
+	h.sessionMutex.Lock()
+	defer h.sessionMutex.Unlock()
+
+	if h.shuttingDown || h.hub.closed() {
+		return false
+	}
+
+	h.sessionWG.Add(1)
+	return true
+}
+
 func (h *Hail) Broadcast(msg []byte) error {
 	if h.hub.closed() {
 		return ErrClose
 	}
 
 	message := &box{t: websocket.TextMessage, msg: msg}
-	h.hub.broadcast <- message
+	span := h.startMessage("hail.broadcast", message, nil)
+	defer span.End()
+
+	if !h.hub.send(h.hub.broadcast, message) {
+		return ErrClose
+	}
+
+	h.forward(&BackplaneMessage{Kind: BackplaneBroadcast}, message)
 
 	return nil
 }
 
 // BroadcastFilter broadcasts a text message to all sessions that fn returns true for.
+// Functions cannot travel between nodes, so only local sessions receive it; use
+// BroadcastNamedFilter to reach the sessions of every node.
 func (h *Hail) BroadcastFilter(msg []byte, fn func(*Session) bool) error {
 	if h.hub.closed() {
 		return ErrClose
 	}
 
 	message := &box{t: websocket.TextMessage, msg: msg, filter: fn}
-	h.hub.broadcast <- message
+	span := h.startMessage("hail.broadcast", message, nil)
+	defer span.End()
+
+	if !h.hub.send(h.hub.broadcast, message) {
+		return ErrClose
+	}
 
 	return nil
 }
@@ -158,19 +357,145 @@ func (h *Hail) BroadcastBinary(msg []byte) error {
 	}
 
 	message := &box{t: websocket.BinaryMessage, msg: msg}
-	h.hub.broadcast <- message
+	span := h.startMessage("hail.broadcast", message, nil)
+	defer span.End()
+
+	if !h.hub.send(h.hub.broadcast, message) {
+		return ErrClose
+	}
+
+	h.forward(&BackplaneMessage{Kind: BackplaneBroadcast}, message)
 
 	return nil
 }
 
 // BroadcastBinaryFilter broadcasts a binary message to all sessions that fn returns true for.
+// Only local sessions receive it, see BroadcastFilter.
 func (h *Hail) BroadcastBinaryFilter(msg []byte, fn func(*Session) bool) error {
 	if h.hub.closed() {
 		return ErrClose
 	}
 
 	message := &box{t: websocket.BinaryMessage, msg: msg, filter: fn}
-	h.hub.broadcast <- message
+	span := h.startMessage("hail.broadcast", message, nil)
+	defer span.End()
+
+	if !h.hub.send(h.hub.broadcast, message) {
+		return ErrClose
+	}
+
+	return nil
+}
+
+// SendTo writes a text message to the session identified by hashID.
+// It returns ErrSessionNotFound when no such session is connected.
+func (h *Hail) SendTo(hashID string, msg []byte) error {
+	return h.sendTo(hashID, &box{t: websocket.TextMessage, msg: msg})
+}
+
+// SendBinaryTo writes a binary message to the session identified by hashID.
+// It returns ErrSessionNotFound when no such session is connected.
+func (h *Hail) SendBinaryTo(hashID string, msg []byte) error {
+	return h.sendTo(hashID, &box{t: websocket.BinaryMessage, msg: msg})
+}
+
+func (h *Hail) sendTo(hashID string, message *box) error {
+	if h.hub.closed() {
+		return ErrClose
+	}
+
+	span := h.startMessage("hail.send", message, map[string]interface{}{AttrSessionID: hashID})
+	defer span.End()
+
+	s, ok := h.hub.get(hashID)
+	if !ok {
+		// 可能連線在其他節點 (the session may be connected to another node)
+		if _, remote := h.directory.get(hashID); remote {
+			h.forward(&BackplaneMessage{Kind: BackplaneSendTo, Target: hashID}, message)
+			return nil
+		}
+
+		return ErrSessionNotFound
+	}
+
+	return s.writeMessage(message)
+}
+
+// SendToUser writes a text message to every session bound to userID.
+// It returns ErrSessionNotFound when the user has no connected session.
+func (h *Hail) SendToUser(userID string, msg []byte) error {
+	return h.sendToUser(userID, &box{t: websocket.TextMessage, msg: msg})
+}
+
+// SendBinaryToUser writes a binary message to every session bound to userID.
+// It returns ErrSessionNotFound when the user has no connected session.
+func (h *Hail) SendBinaryToUser(userID string, msg []byte) error {
+	return h.sendToUser(userID, &box{t: websocket.BinaryMessage, msg: msg})
+}
+
+func (h *Hail) sendToUser(userID string, message *box) error {
+	if h.hub.closed() {
+		return ErrClose
+	}
+
+	span := h.startMessage("hail.send", message, map[string]interface{}{AttrUserID: userID})
+	defer span.End()
+
+	remote := h.directory.user(userID)
+	if len(remote) > 0 {
+		h.forward(&BackplaneMessage{Kind: BackplaneSendToUser, Target: userID}, message)
+	}
+
+	sessions := h.hub.userSessions(userID)
+	if len(sessions) == 0 && len(remote) == 0 {
+		return ErrSessionNotFound
+	}
+
+	for _, s := range sessions {
+		s.writeMessage(message)
+	}
+
+	return nil
+}
+
+// UserSessions returns the connected sessions bound to userID.
+func (h *Hail) UserSessions(userID string) []*Session {
+	return h.hub.userSessions(userID)
+}
+
+// OnlineUsers returns the IDs of the users with at least one connected session.
+func (h *Hail) OnlineUsers() []string {
+	return h.hub.userIDs()
+}
+
+// CloseUser sends msg to every session bound to userID and closes them.
+func (h *Hail) CloseUser(userID string, msg []byte) error {
+	if h.hub.closed() {
+		return ErrClose
+	}
+
+	message := &box{t: websocket.TextMessage, msg: msg}
+	for _, s := range h.hub.userSessions(userID) {
+		s.closeWithMessage(message)
+	}
+
+	return nil
+}
+
+// CloseUserWithReason sends a close frame with code and reason to every session bound to userID and closes them.
+func (h *Hail) CloseUserWithReason(userID string, code int, reason string) error {
+	if h.hub.closed() {
+		return ErrClose
+	}
+
+	message, err := newCloseBox(code, reason)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range h.hub.userSessions(userID) {
+		s.closeWithMessage(message)
+	}
 
 	return nil
 }
@@ -181,7 +506,9 @@ func (h *Hail) CloseAllSession(msg []byte) error {
 	}
 
 	message := &box{t: websocket.TextMessage, msg: msg}
-	h.hub.closeSession <- message
+	if !h.hub.send(h.hub.closeSession, message) {
+		return ErrClose
+	}
 
 	return nil
 }
@@ -192,7 +519,9 @@ func (h *Hail) CloseSessionFilter(msg []byte, fn func(*Session) bool) error {
 	}
 
 	message := &box{t: websocket.TextMessage, msg: msg, filter: fn}
-	h.hub.closeSession <- message
+	if !h.hub.send(h.hub.closeSession, message) {
+		return ErrClose
+	}
 
 	return nil
 }
@@ -203,7 +532,9 @@ func (h *Hail) CloseAllSessionBinary(msg []byte) error {
 	}
 
 	message := &box{t: websocket.BinaryMessage, msg: msg}
-	h.hub.closeSession <- message
+	if !h.hub.send(h.hub.closeSession, message) {
+		return ErrClose
+	}
 
 	return nil
 }
@@ -214,37 +545,178 @@ func (h *Hail) CloseSessionBinaryFilter(msg []byte, fn func(*Session) bool) erro
 	}
 
 	message := &box{t: websocket.BinaryMessage, msg: msg, filter: fn}
-	h.hub.closeSession <- message
+	if !h.hub.send(h.hub.closeSession, message) {
+		return ErrClose
+	}
 
 	return nil
 }
 
+// Session returns the connected session identified by hashID.
+func (h *Hail) Session(hashID string) (*Session, bool) {
+	return h.hub.get(hashID)
+}
+
+// Len returns the number of connected sessions.
+func (h *Hail) Len() int {
+	return h.hub.len()
+}
+
+// Range calls fn for every connected session until fn returns false.
+// fn runs on a snapshot, so it may safely call back into h.
+func (h *Hail) Range(fn func(*Session) bool) {
+	for _, s := range h.hub.list() {
+		if !fn(s) {
+			return
+		}
+	}
+}
+
+// Shutdown gracefully stops h. It refuses new connections, sends a going away close frame
+// to every session and waits until the output queues are drained and the peers have
+// answered the close frame. If ctx expires first, the remaining sessions are closed
+// forcibly and ctx.Err() is returned. Shutdown returns only once every session goroutine has exited.
+// With a Backplane, the other nodes are told that this node left, then the Backplane is closed.
+func (h *Hail) Shutdown(ctx context.Context) error {
+	message := &box{t: websocket.CloseMessage, msg: closeMessage(CloseGoingAway, "")}
+	if h.hub.closed() || !h.hub.send(h.hub.exit, message) {
+		return ErrClose
+	}
+
+	h.Option.Logger.Info("shutting down", "sessions", h.Len())
+
+	h.sessionMutex.Lock()
+	h.shuttingDown = true
+	h.sessionMutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		h.sessionWG.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// 等待對方回應 close frame (wait for the peer to echo the close frame)
+	for _, s := range h.hub.list() {
+		select {
+		case <-s.outputDone:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		s.Close()
+	}
+	<-drained
+
+	h.dropParked()
+	h.pubSub.Shutdown()
+	h.leaveCluster()
+
+	return err
+}
+
+// CloseAllSessionWithReason sends a close frame with code and reason to all sessions and closes them.
+func (h *Hail) CloseAllSessionWithReason(code int, reason string) error {
+	return h.CloseSessionFilterWithReason(code, reason, nil)
+}
+
+// CloseSessionFilterWithReason sends a close frame with code and reason to all sessions
+// that fn returns true for and closes them.
+func (h *Hail) CloseSessionFilterWithReason(code int, reason string, fn func(*Session) bool) error {
+	if h.hub.closed() {
+		return ErrClose
+	}
+
+	message, err := newCloseBox(code, reason)
+	if err != nil {
+		return err
+	}
+	message.filter = fn
+
+	if !h.hub.send(h.hub.closeSession, message) {
+		return ErrClose
+	}
+
+	return nil
+}
+
+// ConfigureTopic sets how the topic retains published messages, such as
+// TopicOptions{Retain: 50} or TopicOptions{RetainFor: time.Minute}. Retained messages are replayed to every new subscriber,
+// including wildcard subscriptions that match the topic.
+func (h *Hail) ConfigureTopic(topic string, options TopicOptions) {
+	h.pubSub.Configure(topic, options)
+}
+
 // PubMsg Publish Message To Session Subscribe （向下相容）
+// Topics containing "+" or "#" are rejected: nothing is published and ErrInvalidTopic is logged.
 func (h *Hail) PubMsg(msg []byte, isAsync bool, topics ...string) {
-	message := &box{t: websocket.TextMessage, msg: msg}
-	if isAsync {
-		h.pubSub.AsyncPub(message, topics...)
-	} else {
-		h.pubSub.Pub(message, topics...)
-	}
+	h.publish(&box{t: websocket.TextMessage, msg: msg}, isAsync, topics)
 }
 
 // PubTextMsg Publish Message To Session Subscribe
+// Topics containing "+" or "#" are rejected: nothing is published and ErrInvalidTopic is logged.
 func (h *Hail) PubTextMsg(msg []byte, isAsync bool, topics ...string) {
-	message := &box{t: websocket.TextMessage, msg: msg}
-	if isAsync {
-		h.pubSub.AsyncPub(message, topics...)
-	} else {
-		h.pubSub.Pub(message, topics...)
-	}
+	h.publish(&box{t: websocket.TextMessage, msg: msg}, isAsync, topics)
 }
 
 // PubBinaryMsg Publish Message To Session Subscribe
+// Topics containing "+" or "#" are rejected: nothing is published and ErrInvalidTopic is logged.
 func (h *Hail) PubBinaryMsg(msg []byte, isAsync bool, topics ...string) {
-	message := &box{t: websocket.BinaryMessage, msg: msg}
+	h.publish(&box{t: websocket.BinaryMessage, msg: msg}, isAsync, topics)
+}
+
+func (h *Hail) publish(message *box, isAsync bool, topics []string) {
+	if !validTopicNames(topics) {
+		h.Option.Logger.Warn("publish rejected", "topics", topics, "error", ErrInvalidTopic)
+		return
+	}
+
+	span := h.startMessage("hail.publish", message, map[string]interface{}{AttrTopic: strings.Join(topics, ",")})
+	defer span.End()
+
+	var report PubReport
 	if isAsync {
-		h.pubSub.AsyncPub(message, topics...)
+		report = h.pubSub.AsyncPub(message, topics...)
 	} else {
-		h.pubSub.Pub(message, topics...)
+		report = h.pubSub.Pub(message, topics...)
 	}
+	h.observers.fanout("publish", report.Subscribers)
+	span.SetAttribute(AttrRecipients, report.Subscribers)
+
+	h.forward(&BackplaneMessage{Kind: BackplanePublish, Topics: topics, Async: isAsync}, message)
+}
+
+// PubTextMsgWithReport publishes a text message to the topic subscribers and reports how many
+// sessions it reached. It returns ErrPublishTimeout, with the partial report, once timeout elapses,
+// and ErrInvalidTopic when a topic contains "+" or "#". The report only covers the local node.
+func (h *Hail) PubTextMsgWithReport(msg []byte, timeout time.Duration, topics ...string) (PubReport, error) {
+	return h.publishWithReport(&box{t: websocket.TextMessage, msg: msg}, timeout, topics)
+}
+
+// PubBinaryMsgWithReport publishes a binary message to the topic subscribers and reports how many
+// sessions it reached. It returns ErrPublishTimeout, with the partial report, once timeout elapses,
+// and ErrInvalidTopic when a topic contains "+" or "#". The report only covers the local node.
+func (h *Hail) PubBinaryMsgWithReport(msg []byte, timeout time.Duration, topics ...string) (PubReport, error) {
+	return h.publishWithReport(&box{t: websocket.BinaryMessage, msg: msg}, timeout, topics)
+}
+
+func (h *Hail) publishWithReport(message *box, timeout time.Duration, topics []string) (PubReport, error) {
+	if !validTopicNames(topics) {
+		return PubReport{}, ErrInvalidTopic
+	}
+
+	span := h.startMessage("hail.publish", message, map[string]interface{}{AttrTopic: strings.Join(topics, ",")})
+	defer span.End()
+
+	report, err := h.pubSub.PubWithReport(message, timeout, topics...)
+	h.observers.fanout("publish", report.Subscribers)
+	span.SetAttribute(AttrRecipients, report.Subscribers)
+	h.forward(&BackplaneMessage{Kind: BackplanePublish, Topics: topics}, message)
+
+	return report, err
 }
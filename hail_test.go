@@ -0,0 +1,136 @@
+package hail_test
+
+import (
+	"context"
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/hailtest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newServer 啟動測試伺服器，"sub:<topic>" 訂閱後回覆 "subscribed"，其他文字訊息原樣回傳
+// (start a test server, "sub:<topic>" subscribes and answers "subscribed", other text messages are echoed)
+func newServer(t *testing.T, o *hail.Option) *hailtest.Server {
+	h := hail.New(o)
+	h.HandleMessage(func(s *hail.Session, msg []byte) {
+		if topic, ok := strings.CutPrefix(string(msg), "sub:"); ok {
+			s.AddSub(topic)
+			s.Write([]byte("subscribed"))
+			return
+		}
+
+		s.Write(msg)
+	})
+
+	srv := hailtest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// subscribe 訂閱完成後才回傳，之後的發布一定會送達 (returns once subscribed, later publishes reach the client)
+func subscribe(c *hailtest.Client, topic string) {
+	c.Send("sub:" + topic)
+	c.Expect("subscribed")
+}
+
+// expectSet 收到 want 中的每則訊息，不論順序 (receive every message of want, in any order)
+func expectSet(t *testing.T, c *hailtest.Client, want ...string) {
+	t.Helper()
+
+	got := make([]string, len(want))
+	for i := range want {
+		got[i] = string(c.Next(hailtest.DefaultTimeout).Data)
+	}
+
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestShutdownClosesSessions(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+	a, b := srv.Dial(t), srv.Dial(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Hail.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	a.ExpectClose(hail.CloseGoingAway)
+	b.ExpectClose(hail.CloseGoingAway)
+	if n := srv.Hail.Len(); n != 0 {
+		t.Fatalf("%d sessions left after Shutdown", n)
+	}
+
+	if err := srv.Hail.Shutdown(ctx); err != hail.ErrClose {
+		t.Fatalf("second Shutdown returned %v, want ErrClose", err)
+	}
+}
+
+func TestSessionRegistry(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+	h := srv.Hail
+	ids := connectID(h)
+
+	srv.Dial(t)
+	srv.Dial(t)
+	first, second := <-ids, <-ids
+
+	if s, ok := h.Session(first); !ok || s.GetHashID() != first {
+		t.Fatalf("Session(%q) = %v, %v", first, s, ok)
+	}
+	if _, ok := h.Session("nope"); ok {
+		t.Fatal("found a session that never connected")
+	}
+
+	if n := h.Len(); n != 2 {
+		t.Fatalf("Len() = %d, want 2", n)
+	}
+
+	seen := make(map[string]bool)
+	h.Range(func(s *hail.Session) bool {
+		seen[s.GetHashID()] = true
+		return true
+	})
+	if !seen[first] || !seen[second] || len(seen) != 2 {
+		t.Fatalf("Range visited %v", seen)
+	}
+
+	visited := 0
+	h.Range(func(s *hail.Session) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Fatalf("Range visited %d sessions after returning false, want 1", visited)
+	}
+}
+
+func TestSendToOneSession(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+	h := srv.Hail
+	ids := connectID(h)
+
+	a := srv.Dial(t)
+	id := <-ids
+	b := srv.Dial(t)
+	<-ids
+
+	if err := h.SendBinaryTo(id, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if m := a.Next(hailtest.DefaultTimeout); m.Type != hail.BinaryMessage || string(m.Data) != "\x01\x02" {
+		t.Fatalf("got %v %q, want a binary message", m.Type, m.Data)
+	}
+	b.ExpectNothing(50 * time.Millisecond)
+
+	if err := h.SendTo("nope", []byte("lost")); err != hail.ErrSessionNotFound {
+		t.Fatalf("got %v, want ErrSessionNotFound", err)
+	}
+}
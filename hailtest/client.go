@@ -0,0 +1,362 @@
+package hailtest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/lishank0119/hail"
+	"io"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// websocket opcodes (RFC 6455, section 5.2)
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Message is a message received by a Client.
+type Message struct {
+	Type hail.MessageType
+	Data []byte
+}
+
+// Client is a websocket client connected to a Server. It speaks RFC 6455 over a plain net.Conn,
+// with a goroutine reading the frames, and its methods report failures to t.
+type Client struct {
+	// Response is the upgrade response, such as to read the resume token header.
+	Response *http.Response
+
+	t        testing.TB
+	conn     net.Conn
+	reader   *bufio.Reader
+	mutex    sync.Mutex // 保護寫入 (guards the writes)
+	messages chan Message
+	pings    chan struct{}
+	closed   chan int
+	once     sync.Once
+	ignore   atomic.Bool
+}
+
+// dial 完成握手並開始讀取，伺服器拒絕時回傳 nil Client 與回應 (handshake and start reading, returns a nil Client and the response on a rejection)
+func dial(t testing.TB, url string, header http.Header) (*Client, *http.Response, error) {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := net.DialTimeout("tcp", u.Host, DefaultTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req, err := http.NewRequest(http.MethodGet, "http"+strings.TrimPrefix(url, "ws"), nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	conn.SetDeadline(time.Now().Add(DefaultTimeout))
+
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(res.Body)
+		res.Body = io.NopCloser(bytes.NewReader(body))
+		conn.Close()
+		return nil, res, nil
+	}
+
+	accept := sha1.Sum([]byte(key + acceptGUID))
+	if res.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		conn.Close()
+		return nil, nil, errors.New("invalid Sec-WebSocket-Accept")
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	c := &Client{
+		Response: res,
+		t:        t,
+		conn:     conn,
+		reader:   reader,
+		messages: make(chan Message, 1024),
+		pings:    make(chan struct{}, 64),
+		closed:   make(chan int, 1),
+	}
+	go c.read()
+
+	return c, res, nil
+}
+
+// read 讀取伺服器的訊框，回應 ping 與 close (read the frames of the server, answering pings and close frames)
+func (c *Client) read() {
+	defer c.once.Do(func() { close(c.closed) })
+	defer c.conn.Close()
+
+	var messageType hail.MessageType
+	var message []byte
+
+	for {
+		op, fin, payload, err := readFrame(c.reader)
+		if err != nil {
+			return
+		}
+
+		switch op {
+		case opText, opBinary:
+			messageType, message = hail.MessageType(op), payload
+		case opContinuation:
+			message = append(message, payload...)
+		case opPing:
+			select {
+			case c.pings <- struct{}{}:
+			default:
+			}
+			if !c.ignore.Load() {
+				c.write(opPong, payload)
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			code := hail.CloseNoStatusReceived
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+				c.write(opClose, payload[:2])
+			} else {
+				c.write(opClose, nil)
+			}
+			c.once.Do(func() {
+				c.closed <- code
+				close(c.closed)
+			})
+			return
+		}
+
+		if fin {
+			c.messages <- Message{Type: messageType, Data: message}
+			message = nil
+		}
+	}
+}
+
+func readFrame(r *bufio.Reader) (op byte, fin bool, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+
+	fin = header[0]&0x80 != 0
+	op = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+
+	size := uint64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(r, mask[:]); err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return
+}
+
+// write 送出一個遮罩過的訊框 (write a masked frame, as clients must)
+func (c *Client) write(op byte, payload []byte) error {
+	frame := []byte{0x80 | op}
+
+	switch size := len(payload); {
+	case size < 126:
+		frame = append(frame, 0x80|byte(size))
+	case size <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(size))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(size))
+	}
+
+	var mask [4]byte
+	rand.Read(mask[:])
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(DefaultTimeout))
+	_, err := c.conn.Write(frame)
+
+	return err
+}
+
+// IgnorePings stops the client from answering pings, to let the session time out.
+func (c *Client) IgnorePings(ignore bool) {
+	c.ignore.Store(ignore)
+}
+
+// Send sends a text message.
+func (c *Client) Send(msg string) {
+	c.t.Helper()
+
+	if err := c.write(opText, []byte(msg)); err != nil {
+		c.t.Fatalf("hailtest: send %q: %v", msg, err)
+	}
+}
+
+// SendBinary sends a binary message.
+func (c *Client) SendBinary(msg []byte) {
+	c.t.Helper()
+
+	if err := c.write(opBinary, msg); err != nil {
+		c.t.Fatalf("hailtest: send binary: %v", err)
+	}
+}
+
+// Next returns the next message, failing the test when none arrives within timeout.
+func (c *Client) Next(timeout time.Duration) Message {
+	c.t.Helper()
+
+	select {
+	case m := <-c.messages:
+		return m
+	case <-time.After(timeout):
+		c.t.Fatalf("hailtest: no message within %s", timeout)
+		return Message{}
+	}
+}
+
+// Expect fails the test unless the next message is the text want, within DefaultTimeout.
+func (c *Client) Expect(want string) {
+	c.t.Helper()
+	c.ExpectWithin(want, DefaultTimeout)
+}
+
+// ExpectWithin fails the test unless the next message is the text want, within timeout.
+func (c *Client) ExpectWithin(want string, timeout time.Duration) {
+	c.t.Helper()
+
+	m := c.Next(timeout)
+	if m.Type != hail.TextMessage || string(m.Data) != want {
+		c.t.Errorf("hailtest: got %q, want %q", m.Data, want)
+	}
+}
+
+// ExpectNothing fails the test when a message arrives within d.
+func (c *Client) ExpectNothing(d time.Duration) {
+	c.t.Helper()
+
+	select {
+	case m := <-c.messages:
+		c.t.Errorf("hailtest: got unexpected %q", m.Data)
+	case <-time.After(d):
+	}
+}
+
+// ExpectPing fails the test unless the server sends a ping within DefaultTimeout.
+func (c *Client) ExpectPing() {
+	c.t.Helper()
+
+	select {
+	case <-c.pings:
+	case <-time.After(DefaultTimeout):
+		c.t.Errorf("hailtest: no ping within %s", DefaultTimeout)
+	}
+}
+
+// ExpectClose fails the test unless the server closes the connection with code within DefaultTimeout.
+// A code of 0 expects the connection to be dropped without a close frame.
+func (c *Client) ExpectClose(code int) {
+	c.t.Helper()
+
+	select {
+	case got, ok := <-c.closed:
+		if !ok {
+			got = 0
+		}
+		if got != code {
+			c.t.Errorf("hailtest: closed with %d, want %d", got, code)
+		}
+	case <-time.After(DefaultTimeout):
+		c.t.Errorf("hailtest: not closed within %s, want %d", DefaultTimeout, code)
+	}
+}
+
+// Close closes the connection with a normal closure.
+func (c *Client) Close() {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(hail.CloseNormalClosure))
+	c.write(opClose, payload)
+	c.conn.Close()
+}
+
+// Drop closes the connection without a close frame, like a network failure.
+func (c *Client) Drop() {
+	c.conn.Close()
+}
@@ -0,0 +1,166 @@
+package hailtest
+
+import (
+	"github.com/lishank0119/hail"
+	"sync"
+	"time"
+)
+
+// Clock is a hail.Clock that only moves with Advance. Set it as Option.Clock to test
+// PingPeriod, PongWait, ResumeGrace, topic retention and rate limits without waiting for them.
+type Clock struct {
+	mutex   sync.Mutex
+	waiters *sync.Cond // 有新的 ticker 或 timer 時通知 (signalled when a ticker or a timer is added)
+	now     time.Time
+	tickers []*ticker
+	timers  []*timer
+}
+
+// NewClock creates a Clock set to the current time.
+func NewClock() *Clock {
+	c := &Clock{now: time.Now()}
+	c.waiters = sync.NewCond(&c.mutex)
+
+	return c
+}
+
+// Now implements hail.Clock.
+func (c *Clock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+// NewTicker implements hail.Clock.
+func (c *Clock) NewTicker(d time.Duration) hail.Ticker {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	t := &ticker{clock: c, period: d, next: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.tickers = append(c.tickers, t)
+	c.waiters.Broadcast()
+
+	return t
+}
+
+// AfterFunc implements hail.Clock. f is called by Advance, on the goroutine calling it.
+func (c *Clock) AfterFunc(d time.Duration, f func()) hail.Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	t := &timer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	c.waiters.Broadcast()
+
+	return t
+}
+
+// BlockUntil waits until at least n tickers and timers are running on the clock. Every session
+// runs one ping ticker, created before its upgrade is answered.
+func (c *Clock) BlockUntil(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for len(c.tickers)+len(c.timers) < n {
+		c.waiters.Wait()
+	}
+}
+
+// Advance moves the clock forward by d, firing the tickers and calling the AfterFunc functions
+// that are due, in time order. Like time.Ticker, a ticker whose tick was not received yet drops
+// the following ones. Advance returns once the due functions have returned.
+func (c *Clock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	end := c.now.Add(d)
+
+	for {
+		// 下一個到期的 ticker 或 timer (the next ticker or timer due)
+		var next time.Time
+		var due *timer
+		var tick *ticker
+		for _, t := range c.tickers {
+			if !t.next.After(end) && (next.IsZero() || t.next.Before(next)) {
+				next, tick = t.next, t
+			}
+		}
+		for _, t := range c.timers {
+			if !t.at.After(end) && (next.IsZero() || t.at.Before(next)) {
+				next, due, tick = t.at, t, nil
+			}
+		}
+
+		if tick == nil && due == nil {
+			break
+		}
+
+		if next.After(c.now) {
+			c.now = next
+		}
+
+		if tick != nil {
+			select {
+			case tick.c <- tick.next:
+			default:
+			}
+			tick.next = tick.next.Add(tick.period)
+			continue
+		}
+
+		c.remove(due)
+		c.mutex.Unlock()
+		due.f()
+		c.mutex.Lock()
+	}
+
+	c.now = end
+	c.mutex.Unlock()
+}
+
+// remove must be called with mutex held.
+func (c *Clock) remove(t *timer) bool {
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+type ticker struct {
+	clock  *Clock
+	period time.Duration
+	next   time.Time
+	c      chan time.Time
+}
+
+func (t *ticker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *ticker) Stop() {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	for i, other := range t.clock.tickers {
+		if other == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+type timer struct {
+	clock *Clock
+	at    time.Time
+	f     func()
+}
+
+func (t *timer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	return t.clock.remove(t)
+}
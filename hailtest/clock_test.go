@@ -0,0 +1,62 @@
+package hailtest_test
+
+import (
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/hailtest"
+	"testing"
+	"time"
+)
+
+func TestClockPongTimeout(t *testing.T) {
+	clock := hailtest.NewClock()
+	h := hail.New(&hail.Option{Clock: clock, PingPeriod: 50 * time.Second, PongWait: 60 * time.Second})
+
+	pongs := make(chan struct{}, 4)
+	h.HandlePong(func(*hail.Session) {
+		pongs <- struct{}{}
+	})
+
+	srv := hailtest.NewServer(h)
+	defer srv.Close()
+
+	c := srv.Dial(t)
+	clock.BlockUntil(1)
+
+	expectPong := func() {
+		t.Helper()
+		select {
+		case <-pongs:
+		case <-time.After(hailtest.DefaultTimeout):
+			t.Fatal("no pong")
+		}
+	}
+
+	clock.Advance(50 * time.Second)
+	c.ExpectPing()
+	expectPong()
+
+	// 上一個 pong 在 50 秒，還沒超過 PongWait (the last pong came at 50s, within PongWait)
+	clock.Advance(50 * time.Second)
+	c.ExpectPing()
+	expectPong()
+
+	c.IgnorePings(true)
+	clock.Advance(50 * time.Second)
+	c.ExpectPing()
+
+	clock.Advance(50 * time.Second)
+	c.ExpectClose(0)
+}
+
+func TestClockAdvanceRightAfterDial(t *testing.T) {
+	clock := hailtest.NewClock()
+	h := hail.New(&hail.Option{Clock: clock, PingPeriod: time.Minute})
+	srv := hailtest.NewServer(h)
+	defer srv.Close()
+
+	for i := 0; i < 5; i++ {
+		c := srv.Dial(t)
+		clock.Advance(time.Minute)
+		c.ExpectPing()
+	}
+}
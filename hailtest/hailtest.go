@@ -0,0 +1,108 @@
+// Package hailtest provides a server and client harness for testing hail handlers,
+// and a Clock to drive PingPeriod and PongWait without waiting.
+package hailtest
+
+import (
+	"context"
+	"github.com/lishank0119/hail"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// DefaultTimeout is how long Expect waits for a message or a close frame.
+var DefaultTimeout = 2 * time.Second
+
+// Server serves a hail.Hail on an ephemeral local listener.
+type Server struct {
+	URL  string // ws:// URL of the server
+	Hail *hail.Hail
+
+	http *httptest.Server
+}
+
+// NewServer starts a server upgrading every request with h.AddConnect. Close it once the test is done.
+func NewServer(h *hail.Hail) *Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.AddConnect(w, r, nil)
+	}))
+
+	return &Server{
+		URL:  "ws" + strings.TrimPrefix(srv.URL, "http"),
+		Hail: h,
+		http: srv,
+	}
+}
+
+// Close shuts the Hail down, waiting up to DefaultTimeout for the sessions to close, and stops the server.
+func (s *Server) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+
+	s.Hail.Shutdown(ctx)
+	s.http.CloseClientConnections()
+	s.http.Close()
+}
+
+// Dial connects a client to the server.
+func (s *Server) Dial(t testing.TB) *Client {
+	t.Helper()
+	return s.DialWith(t, "", nil)
+}
+
+// DialWith connects a client to the server with a query string, such as "token=...", and headers.
+func (s *Server) DialWith(t testing.TB, query string, header http.Header) *Client {
+	t.Helper()
+
+	c, res := s.TryDial(t, query, header)
+	if c == nil {
+		t.Fatalf("hailtest: dial: %s", res.Status)
+	}
+
+	return c
+}
+
+// TryDial connects a client to the server like DialWith, but returns a nil Client and the response
+// when the server rejects the upgrade, such as with 401 or 429.
+func (s *Server) TryDial(t testing.TB, query string, header http.Header) (*Client, *http.Response) {
+	t.Helper()
+
+	url := s.URL
+	if query != "" {
+		url += "?" + query
+	}
+
+	c, res, err := dial(t, url, header)
+	if err != nil {
+		t.Fatalf("hailtest: dial %s: %v", url, err)
+	}
+
+	return c, res
+}
+
+// ExpectBroadcast fails the test unless every client receives the text want.
+func ExpectBroadcast(t testing.TB, want string, clients ...*Client) {
+	t.Helper()
+
+	for _, c := range clients {
+		c.Expect(want)
+	}
+}
+
+// ExpectTopic publishes msg to topic and fails the test unless every subscriber receives it,
+// and none of the others does within DefaultTimeout / 10.
+func ExpectTopic(t testing.TB, h *hail.Hail, topic, msg string, subscribers []*Client, others []*Client) {
+	t.Helper()
+
+	h.PubTextMsg([]byte(msg), false, topic)
+
+	for _, c := range subscribers {
+		c.Expect(msg)
+	}
+
+	for _, c := range others {
+		c.ExpectNothing(DefaultTimeout / 10)
+	}
+}
@@ -0,0 +1,151 @@
+package hailtest_test
+
+import (
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/hailtest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newEcho(t *testing.T) *hailtest.Server {
+	h := hail.New(&hail.Option{})
+	h.HandleMessage(func(s *hail.Session, msg []byte) {
+		s.Write(msg)
+	})
+
+	srv := hailtest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestClientEcho(t *testing.T) {
+	srv := newEcho(t)
+
+	c := srv.Dial(t)
+	c.Send("hello")
+	c.Expect("hello")
+	c.ExpectNothing(50 * time.Millisecond)
+}
+
+func TestClientBinary(t *testing.T) {
+	h := hail.New(&hail.Option{})
+	h.HandleMessageBinary(func(s *hail.Session, msg []byte) {
+		s.WriteBinary(msg)
+	})
+	srv := hailtest.NewServer(h)
+	defer srv.Close()
+
+	c := srv.Dial(t)
+	payload := make([]byte, 70000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	c.SendBinary(payload)
+
+	m := c.Next(hailtest.DefaultTimeout)
+	if m.Type != hail.BinaryMessage || len(m.Data) != len(payload) || m.Data[69999] != payload[69999] {
+		t.Fatalf("got type %d, %d bytes", m.Type, len(m.Data))
+	}
+}
+
+func TestExpectBroadcastAndTopic(t *testing.T) {
+	srv := newEcho(t)
+	h := srv.Hail
+
+	subscribed := make(chan struct{}, 1)
+	h.HandleTopicPresence(func(s *hail.Session, topic string, joined bool) {
+		if topic == "room" && joined {
+			subscribed <- struct{}{}
+		}
+	})
+	h.HandleConnect(func(s *hail.Session) {
+		if s.Request.URL.Query().Get("room") != "" {
+			s.AddSub("room")
+		}
+	})
+
+	a := srv.DialWith(t, "room=1", nil)
+	b := srv.Dial(t)
+	<-subscribed
+
+	hailtest.ExpectTopic(t, h, "room", "news", []*hailtest.Client{a}, []*hailtest.Client{b})
+
+	h.Broadcast([]byte("all"))
+	hailtest.ExpectBroadcast(t, "all", a, b)
+}
+
+func TestSendToAndClose(t *testing.T) {
+	srv := newEcho(t)
+	h := srv.Hail
+
+	connected := make(chan string, 1)
+	h.HandleConnect(func(s *hail.Session) {
+		connected <- s.GetHashID()
+	})
+
+	c := srv.Dial(t)
+	id := <-connected
+
+	if err := h.SendTo(id, []byte("direct")); err != nil {
+		t.Fatal(err)
+	}
+	c.Expect("direct")
+
+	s, ok := h.Session(id)
+	if !ok {
+		t.Fatal("session not found")
+	}
+	s.CloseWithReason(hail.ClosePolicyViolation, "kicked")
+	c.ExpectClose(hail.ClosePolicyViolation)
+}
+
+func TestTryDialRejected(t *testing.T) {
+	h := hail.New(&hail.Option{
+		Authenticate: func(r *http.Request) (hail.Identity, map[string]interface{}, error) {
+			return hail.Identity{}, nil, &hail.AuthError{Status: http.StatusForbidden, Message: "no"}
+		},
+	})
+	srv := hailtest.NewServer(h)
+	defer srv.Close()
+
+	c, res := srv.TryDial(t, "", nil)
+	if c != nil || res.StatusCode != http.StatusForbidden {
+		t.Fatalf("got %v, want 403", res.Status)
+	}
+}
+
+func TestServerCloseShutsDown(t *testing.T) {
+	h := hail.New(&hail.Option{})
+	srv := hailtest.NewServer(h)
+
+	c := srv.Dial(t)
+	srv.Close()
+	c.ExpectClose(hail.CloseGoingAway)
+
+	if err := h.Broadcast([]byte("late")); err != hail.ErrClose {
+		t.Fatalf("got %v, want ErrClose", err)
+	}
+}
+
+func TestClientDrop(t *testing.T) {
+	srv := newEcho(t)
+
+	disconnected := make(chan hail.DisconnectInfo, 1)
+	srv.Hail.HandleDisconnectInfo(func(s *hail.Session, info hail.DisconnectInfo) {
+		disconnected <- info
+	})
+
+	c := srv.Dial(t)
+	c.Drop()
+
+	select {
+	case info := <-disconnected:
+		if info.Cause != hail.DisconnectNetwork {
+			t.Fatalf("got cause %s, want network", info.Cause)
+		}
+	case <-time.After(hailtest.DefaultTimeout):
+		t.Fatal("no disconnect")
+	}
+}
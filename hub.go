@@ -2,32 +2,43 @@ package hail
 
 import (
 	"sync"
-	"time"
 )
 
 type hub struct {
 	Option       *Option
 	sessions     map[*Session]bool
+	ids          map[string]*Session          // Key: hashID
+	users        map[string]map[*Session]bool // Key: userID, 由 userMutex 保護 (guarded by userMutex)
+	indexed      map[*Session]bool            // 已註冊、在 users 索引中的 session，由 userMutex 保護 (registered sessions, in the users index, guarded by userMutex)
 	open         bool
 	rwMutex      *sync.RWMutex
+	userMutex    *sync.RWMutex // 與 rwMutex 分開，Broadcast 的 filter 可以呼叫 BindUser (separate from rwMutex, so a Broadcast filter may call BindUser)
 	register     chan *Session
 	unregister   chan *Session
 	broadcast    chan *box
 	exit         chan *box
 	closeSession chan *box
+	done         chan struct{}
+	observers    *observers
 }
 
 func newHub(o *Option) *hub {
 	return &hub{
 		Option:       o,
 		sessions:     make(map[*Session]bool),
+		ids:          make(map[string]*Session),
+		users:        make(map[string]map[*Session]bool),
+		indexed:      make(map[*Session]bool),
 		open:         true,
 		rwMutex:      &sync.RWMutex{},
+		userMutex:    &sync.RWMutex{},
 		register:     make(chan *Session),
 		unregister:   make(chan *Session),
 		broadcast:    make(chan *box),
 		exit:         make(chan *box),
 		closeSession: make(chan *box),
+		done:         make(chan struct{}),
+		observers:    &observers{},
 	}
 }
 
@@ -37,59 +48,186 @@ func (h *hub) closed() bool {
 	return !h.open
 }
 
+// send hands m to ch unless the hub has already stopped running.
+func (h *hub) send(ch chan *box, m *box) bool {
+	select {
+	case ch <- m:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// list returns a snapshot of the sessions known by the hub.
+func (h *hub) list() []*Session {
+	h.rwMutex.RLock()
+	defer h.rwMutex.RUnlock()
+
+	sessions := make([]*Session, 0, len(h.sessions))
+	for s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+
+	return sessions
+}
+
+// get returns the session registered with hashID.
+func (h *hub) get(hashID string) (*Session, bool) {
+	h.rwMutex.RLock()
+	defer h.rwMutex.RUnlock()
+
+	s, ok := h.ids[hashID]
+	return s, ok
+}
+
+// len returns the number of registered sessions.
+func (h *hub) len() int {
+	h.rwMutex.RLock()
+	defer h.rwMutex.RUnlock()
+
+	return len(h.sessions)
+}
+
+// bindUser 綁定 session 與 userID，已註冊的 session 會同步更新索引 (bind a session to userID and keep the user index in sync)
+// It returns whether the session is registered and the user it was bound to before.
+// It only takes userMutex, so it may be called while rwMutex is held.
+func (h *hub) bindUser(s *Session, userID string) (registered bool, previous string) {
+	h.userMutex.Lock()
+	defer h.userMutex.Unlock()
+
+	registered = h.indexed[s]
+	previous = s.userID
+	if registered {
+		h.removeUser(s)
+	}
+
+	s.userID = userID
+
+	if registered {
+		h.addUser(s)
+	}
+
+	return registered, previous
+}
+
+// addUser must be called with userMutex held.
+func (h *hub) addUser(s *Session) {
+	if s.userID == "" {
+		return
+	}
+
+	if h.users[s.userID] == nil {
+		h.users[s.userID] = make(map[*Session]bool)
+	}
+	h.users[s.userID][s] = true
+}
+
+// remove 移除Session，hub 結束後由關閉的Session自己呼叫 (remove a session, called by the closing session itself once the hub has stopped)
+func (h *hub) remove(s *Session) bool {
+	h.rwMutex.Lock()
+	_, ok := h.sessions[s]
+	if ok {
+		delete(h.sessions, s)
+		if h.ids[s.hashID] == s {
+			delete(h.ids, s.hashID)
+		}
+	}
+	h.rwMutex.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	h.userMutex.Lock()
+	delete(h.indexed, s)
+	h.removeUser(s)
+	h.userMutex.Unlock()
+
+	return true
+}
+
+// removeUser must be called with userMutex held.
+func (h *hub) removeUser(s *Session) {
+	if s.userID == "" {
+		return
+	}
+
+	delete(h.users[s.userID], s)
+	if len(h.users[s.userID]) == 0 {
+		delete(h.users, s.userID)
+	}
+}
+
+// userSessions returns a snapshot of the sessions bound to userID.
+func (h *hub) userSessions(userID string) []*Session {
+	h.userMutex.RLock()
+	defer h.userMutex.RUnlock()
+
+	sessions := make([]*Session, 0, len(h.users[userID]))
+	for s := range h.users[userID] {
+		sessions = append(sessions, s)
+	}
+
+	return sessions
+}
+
+// userIDs returns the users that have at least one registered session.
+func (h *hub) userIDs() []string {
+	h.userMutex.RLock()
+	defer h.userMutex.RUnlock()
+
+	users := make([]string, 0, len(h.users))
+	for userID := range h.users {
+		users = append(users, userID)
+	}
+
+	return users
+}
+
 func (h *hub) run() {
+	defer close(h.done)
+
 loop:
 	for {
 		select {
 		case s := <-h.register:
 			h.rwMutex.Lock()
 			h.sessions[s] = true
+			h.ids[s.hashID] = s
 			h.rwMutex.Unlock()
+
+			h.userMutex.Lock()
+			h.indexed[s] = true
+			h.addUser(s)
+			h.userMutex.Unlock()
 		case s := <-h.unregister:
-			if _, ok := h.sessions[s]; ok {
-				h.rwMutex.Lock()
-				delete(h.sessions, s)
-				h.rwMutex.Unlock()
-			}
+			h.remove(s)
 		case m := <-h.closeSession:
-			h.rwMutex.Lock()
-			for s := range h.sessions {
-				if m.filter != nil {
-					if m.filter(s) {
-						s.writeMessage(m)
-						time.AfterFunc(h.Option.CloseSessionWaitTime, func() {
-							s.Close()
-						})
-					}
-				} else {
-					s.writeMessage(m)
-					time.AfterFunc(h.Option.CloseSessionWaitTime, func() {
-						s.Close()
-					})
+			// filter 在鎖外執行，可以呼叫 hub 的方法 (filters run outside the lock, so they may call into the hub)
+			for _, s := range h.list() {
+				if m.filter == nil || m.filter(s) {
+					s.closeWithMessage(m)
 				}
 			}
-			h.rwMutex.Unlock()
 		case m := <-h.broadcast:
-			h.rwMutex.RLock()
-			for s := range h.sessions {
-				if m.filter != nil {
-					if m.filter(s) {
-						s.writeMessage(m)
-					}
-				} else {
-					s.writeMessage(m)
+			recipients := 0
+			for _, s := range h.list() {
+				if m.filter == nil || m.filter(s) {
+					s.deliver(m)
+					recipients++
 				}
 			}
-			h.rwMutex.RUnlock()
+			h.observers.fanout("broadcast", recipients)
 		case m := <-h.exit:
+			// 只送出關閉訊息，讓 session 自行把 output 排空後結束 (sessions drain their output and exit by themselves)
 			h.rwMutex.Lock()
-			for s := range h.sessions {
-				s.writeMessage(m)
-				delete(h.sessions, s)
-				s.Close()
-			}
 			h.open = false
 			h.rwMutex.Unlock()
+
+			for _, s := range h.list() {
+				s.setDisconnect(DisconnectShutdown, m, nil)
+				s.writeMessage(m)
+			}
 			break loop
 		}
 	}
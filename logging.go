@@ -0,0 +1,38 @@
+package hail
+
+import (
+	"context"
+	"log/slog"
+)
+
+// 日誌屬性的名稱 (names of the log attributes)
+const (
+	logSessionID  = "session_id"
+	logRemoteAddr = "remote_addr"
+	logUserID     = "user_id"
+	logTopic      = "topic"
+)
+
+// discardHandler 不輸出任何記錄，是預設的 Logger (writes nothing, backs the default Logger)
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// Logger returns the logger of the session, Option.Logger with the session ID, remote address
+// and, for an authenticated session, user ID attributes.
+func (s *Session) Logger() *slog.Logger {
+	return s.logger
+}
+
+// newLogger 建立Session的子logger，在恢復之後呼叫 (create the child logger of the session, called once it is restored)
+func (s *Session) newLogger() *slog.Logger {
+	args := []any{logSessionID, s.hashID, logRemoteAddr, s.Request.RemoteAddr}
+	if s.identity.UserID != "" {
+		args = append(args, logUserID, s.identity.UserID)
+	}
+
+	return s.hail.Option.Logger.With(args...)
+}
@@ -0,0 +1,60 @@
+package hail_test
+
+import (
+	"bytes"
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/hailtest"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lockedBuffer 可同時寫入的 bytes.Buffer (a bytes.Buffer safe for concurrent writes)
+type lockedBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.buf.String()
+}
+
+func TestSessionLoggerAttributes(t *testing.T) {
+	var out lockedBuffer
+	h := hail.New(&hail.Option{Logger: slog.New(slog.NewJSONHandler(&out, nil))})
+	h.HandleMessage(func(s *hail.Session, msg []byte) {
+		s.Logger().Info("handled")
+		s.Write(msg)
+	})
+
+	srv := hailtest.NewServer(h)
+	t.Cleanup(srv.Close)
+	ids := connectID(h)
+
+	c := srv.Dial(t)
+	id := <-ids
+	c.Send("hi")
+	c.Expect("hi")
+
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.Contains(line, `"msg":"handled"`) {
+			if !strings.Contains(line, `"session_id":"`+id+`"`) || !strings.Contains(line, `"remote_addr":`) {
+				t.Fatalf("log line %s lacks the session attributes", line)
+			}
+			return
+		}
+	}
+
+	t.Fatalf("no log line for the handled message in %s", out.String())
+}
@@ -0,0 +1,248 @@
+// Package metrics exports the metrics of a hail.Hail instance in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"github.com/lishank0119/hail"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// FanoutBuckets 廣播與發布的接收者數量 (recipients of a broadcast or publish)
+	FanoutBuckets = []float64{0, 1, 5, 10, 50, 100, 500, 1000, 5000, 10000}
+	// QueueBuckets 寫出時輸出緩衝區剩餘的訊息數 (messages left in the output buffer after a write)
+	QueueBuckets = []float64{0, 1, 4, 16, 64, 256, 1024, 4096}
+	// LatencyBuckets 寫出與 ping 往返的秒數 (seconds of a write or of a ping round trip)
+	LatencyBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+)
+
+// Collector observes a hail.Hail instance and serves its metrics in the Prometheus text
+// exposition format. It implements http.Handler.
+type Collector struct {
+	hail  *hail.Hail
+	mutex sync.Mutex
+
+	connects         float64
+	disconnects      map[string]float64 // Key: cause
+	messagesReceived map[string]float64 // Key: type
+	bytesReceived    map[string]float64
+	messagesSent     map[string]float64
+	bytesSent        map[string]float64
+	dropped          float64
+	fanout           map[string]*histogram // Key: kind
+	queueDepth       *histogram
+	writeLatency     *histogram
+	pingRTT          *histogram
+}
+
+// New creates a Collector and registers it as an observer of h.
+func New(h *hail.Hail) *Collector {
+	c := &Collector{
+		hail:             h,
+		disconnects:      make(map[string]float64),
+		messagesReceived: make(map[string]float64),
+		bytesReceived:    make(map[string]float64),
+		messagesSent:     make(map[string]float64),
+		bytesSent:        make(map[string]float64),
+		fanout:           make(map[string]*histogram),
+		queueDepth:       newHistogram(QueueBuckets),
+		writeLatency:     newHistogram(LatencyBuckets),
+		pingRTT:          newHistogram(LatencyBuckets),
+	}
+
+	h.Observe(c)
+
+	return c
+}
+
+func messageType(t hail.MessageType) string {
+	if t == hail.BinaryMessage {
+		return "binary"
+	}
+
+	return "text"
+}
+
+// SessionConnected implements hail.Observer.
+func (c *Collector) SessionConnected(*hail.Session) {
+	c.mutex.Lock()
+	c.connects++
+	c.mutex.Unlock()
+}
+
+// SessionDisconnected implements hail.Observer.
+func (c *Collector) SessionDisconnected(_ *hail.Session, info hail.DisconnectInfo) {
+	c.mutex.Lock()
+	c.disconnects[info.Cause.String()]++
+	c.mutex.Unlock()
+}
+
+// MessageReceived implements hail.Observer.
+func (c *Collector) MessageReceived(_ *hail.Session, t hail.MessageType, size int) {
+	c.mutex.Lock()
+	c.messagesReceived[messageType(t)]++
+	c.bytesReceived[messageType(t)] += float64(size)
+	c.mutex.Unlock()
+}
+
+// MessageSent implements hail.Observer.
+func (c *Collector) MessageSent(_ *hail.Session, t hail.MessageType, size int, latency time.Duration, queued int) {
+	c.mutex.Lock()
+	c.messagesSent[messageType(t)]++
+	c.bytesSent[messageType(t)] += float64(size)
+	c.writeLatency.observe(latency.Seconds())
+	c.queueDepth.observe(float64(queued))
+	c.mutex.Unlock()
+}
+
+// MessageDropped implements hail.Observer.
+func (c *Collector) MessageDropped(*hail.Session) {
+	c.mutex.Lock()
+	c.dropped++
+	c.mutex.Unlock()
+}
+
+// Fanout implements hail.Observer.
+func (c *Collector) Fanout(kind string, recipients int) {
+	c.mutex.Lock()
+	if c.fanout[kind] == nil {
+		c.fanout[kind] = newHistogram(FanoutBuckets)
+	}
+	c.fanout[kind].observe(float64(recipients))
+	c.mutex.Unlock()
+}
+
+// PingRTT implements hail.Observer.
+func (c *Collector) PingRTT(_ *hail.Session, rtt time.Duration) {
+	c.mutex.Lock()
+	c.pingRTT.observe(rtt.Seconds())
+	c.mutex.Unlock()
+}
+
+// ServeHTTP writes every metric in the Prometheus text exposition format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	// 先查詢 hail，避免持有 mutex 時等待 (query hail first, so the mutex is never held while waiting)
+	sessions := c.hail.Len()
+	topics := c.hail.TopicStats()
+
+	b := bufio.NewWriter(w)
+	defer b.Flush()
+
+	e := encoder{b}
+	e.gauge("hail_sessions_active", "Sessions currently connected.", float64(sessions))
+	e.gauge("hail_pubsub_topics", "Topics with at least one subscriber.", float64(topics.Topics))
+	e.gauge("hail_pubsub_subscriptions", "Subscriptions over every topic.", float64(topics.Subscriptions))
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e.counter("hail_connects_total", "Sessions connected.", c.connects)
+	e.counters("hail_disconnects_total", "Sessions disconnected, by cause.", "cause", c.disconnects)
+	e.counters("hail_messages_received_total", "Messages received, by type.", "type", c.messagesReceived)
+	e.counters("hail_bytes_received_total", "Bytes received, by type.", "type", c.bytesReceived)
+	e.counters("hail_messages_sent_total", "Messages sent, by type.", "type", c.messagesSent)
+	e.counters("hail_bytes_sent_total", "Bytes sent, by type.", "type", c.bytesSent)
+	e.counter("hail_messages_dropped_total", "Messages dropped because the output buffer was full.", c.dropped)
+	e.histograms("hail_fanout_recipients", "Sessions reached by a broadcast or publish, by kind.", "kind", c.fanout)
+	e.histogram("hail_output_queue_depth", "Messages waiting in the output buffer after a write.", c.queueDepth)
+	e.histogram("hail_write_latency_seconds", "Time spent writing a message to the connection.", c.writeLatency)
+	e.histogram("hail_ping_rtt_seconds", "Round trip time of a ping.", c.pingRTT)
+}
+
+// histogram 累計的直方圖 (a cumulative histogram)
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// encoder 寫出 Prometheus 文字格式 (writes the Prometheus text format)
+type encoder struct {
+	w *bufio.Writer
+}
+
+func (e encoder) header(name, help, kind string) {
+	e.w.WriteString("# HELP " + name + " " + help + "\n# TYPE " + name + " " + kind + "\n")
+}
+
+func (e encoder) sample(name, labels string, v float64) {
+	e.w.WriteString(name)
+	if labels != "" {
+		e.w.WriteString("{" + labels + "}")
+	}
+	e.w.WriteString(" " + strconv.FormatFloat(v, 'g', -1, 64) + "\n")
+}
+
+func (e encoder) gauge(name, help string, v float64) {
+	e.header(name, help, "gauge")
+	e.sample(name, "", v)
+}
+
+func (e encoder) counter(name, help string, v float64) {
+	e.header(name, help, "counter")
+	e.sample(name, "", v)
+}
+
+func (e encoder) counters(name, help, label string, values map[string]float64) {
+	e.header(name, help, "counter")
+	for _, key := range sortedKeys(values) {
+		e.sample(name, label+"="+strconv.Quote(key), values[key])
+	}
+}
+
+func (e encoder) histogram(name, help string, h *histogram) {
+	e.header(name, help, "histogram")
+	e.buckets(name, "", h)
+}
+
+func (e encoder) histograms(name, help, label string, values map[string]*histogram) {
+	e.header(name, help, "histogram")
+	for _, key := range sortedKeys(values) {
+		e.buckets(name, label+"="+strconv.Quote(key), values[key])
+	}
+}
+
+func (e encoder) buckets(name, labels string, h *histogram) {
+	prefix := labels
+	if prefix != "" {
+		prefix += ","
+	}
+
+	for i, bound := range h.buckets {
+		e.sample(name+"_bucket", prefix+`le="`+strconv.FormatFloat(bound, 'g', -1, 64)+`"`, float64(h.counts[i]))
+	}
+	e.sample(name+"_bucket", prefix+`le="+Inf"`, float64(h.count))
+	e.sample(name+"_sum", labels, h.sum)
+	e.sample(name+"_count", labels, float64(h.count))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
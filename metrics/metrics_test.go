@@ -0,0 +1,45 @@
+package metrics_test
+
+import (
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/hailtest"
+	"github.com/lishank0119/hail/metrics"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCollectorServesMetrics(t *testing.T) {
+	h := hail.New(&hail.Option{})
+	h.HandleMessage(func(s *hail.Session, msg []byte) {
+		s.Write(msg)
+	})
+	collector := metrics.New(h)
+
+	srv := hailtest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	c := srv.Dial(t)
+	c.Send("hello")
+	c.Expect("hello")
+
+	w := httptest.NewRecorder()
+	collector.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("got content type %q", ct)
+	}
+
+	body := w.Body.String()
+	for _, want := range []string{
+		"hail_sessions_active 1\n",
+		"hail_connects_total 1\n",
+		`hail_messages_received_total{type="text"} 1` + "\n",
+		`hail_bytes_received_total{type="text"} 5` + "\n",
+		"# TYPE hail_write_latency_seconds histogram\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("missing %q in\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package hail
+
+import "github.com/lesismal/nbio/nbhttp/websocket"
+
+// Handler handles a text or binary message of a session.
+type Handler func(s *Session, t MessageType, msg []byte) error
+
+// Middleware wraps a Handler. It can transform msg before calling next, drop the message by
+// returning without calling next, or annotate the session with Set.
+type Middleware func(next Handler) Handler
+
+// Use wraps the dispatch of inbound messages, to the event router, HandleMessage and
+// HandleMessageBinary, with middlewares. The first middleware is the outermost one.
+// Errors returned by the chain go to HandleError.
+func (h *Hail) Use(middlewares ...Middleware) {
+	h.inbound = chain(h.inbound, middlewares)
+	h.inboundHandler = h.inbound(h.dispatch)
+}
+
+// UseOutbound wraps the writing of outgoing text and binary messages with middlewares, they run on
+// the session write goroutine right before the message is written. Errors returned by a middleware
+// go to HandleError and the message is dropped. HandleSentMessage receives the payload as written.
+func (h *Hail) UseOutbound(middlewares ...Middleware) {
+	h.outbound = chain(h.outbound, middlewares)
+	h.outboundHandler = h.outbound(writeOut)
+}
+
+// chain 將新的middleware包在既有的內層 (wrap new middlewares inside the previous ones)
+func chain(previous Middleware, middlewares []Middleware) Middleware {
+	return func(last Handler) Handler {
+		next := last
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+
+		if previous != nil {
+			return previous(next)
+		}
+
+		return next
+	}
+}
+
+// receive 經過 inbound middleware 處理收到的訊息 (handle an inbound message through the inbound middlewares)
+func (s *Session) receive(t MessageType, msg []byte) {
+	span := s.startReceive(t, msg)
+	defer span.End()
+
+	s.setReceived(span.Context())
+	defer s.setReceived(SpanContext{})
+
+	if err := s.hail.inboundHandler(s, t, msg); err != nil {
+		span.SetAttribute(AttrError, err.Error())
+		s.hail.errorHandler(s, err)
+	}
+}
+
+// writeOut outbound middleware 的最內層，記下實際寫出的訊息 (the innermost outbound handler, records the message actually written)
+func writeOut(s *Session, t MessageType, msg []byte) error {
+	s.sent = &box{t: t, msg: msg}
+	s.sendErr = s.writeRaw(s.sent)
+	return s.sendErr
+}
+
+// send 經過 outbound middleware 寫出訊息，回傳實際寫出的訊息，被丟棄時為nil；只有寫入失敗才回傳錯誤
+// (write a message through the outbound middlewares and return the message written, nil when dropped; only a failed write returns an error)
+func (s *Session) send(message *box) (*box, error) {
+	if s.hail.outboundHandler == nil || (message.t != websocket.TextMessage && message.t != websocket.BinaryMessage) {
+		return message, s.writeRaw(message)
+	}
+
+	s.sent, s.sendErr = nil, nil
+
+	// 寫入失敗由 run 處理 (a failed write is handled by run)
+	if chainErr := s.hail.outboundHandler(s, message.t, message.msg); chainErr != nil && s.sent == nil {
+		s.hail.errorHandler(s, chainErr)
+	}
+
+	return s.sent, s.sendErr
+}
+
+// dispatch 處理收到的訊息 (handle an inbound message)
+func (h *Hail) dispatch(s *Session, t MessageType, msg []byte) error {
+	if t == websocket.TextMessage && !h.route(s, msg) {
+		h.messageHandler(s, msg)
+	}
+
+	if t == websocket.BinaryMessage {
+		h.messageHandlerBinary(s, msg)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package hail_test
+
+import (
+	"bytes"
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/hailtest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareChainsAreBuiltOnce(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+	h := srv.Hail
+
+	var built atomic.Int32
+	h.Use(func(next hail.Handler) hail.Handler {
+		built.Add(1)
+		return next
+	})
+	h.UseOutbound(func(next hail.Handler) hail.Handler {
+		built.Add(1)
+		return next
+	})
+
+	c := srv.Dial(t)
+	for _, m := range []string{"a", "b", "c"} {
+		c.Send(m)
+		c.Expect(m)
+	}
+
+	if n := built.Load(); n != 2 {
+		t.Fatalf("middlewares were wrapped %d times, want 2", n)
+	}
+}
+
+func TestSentHandlerGetsWrittenPayload(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+	h := srv.Hail
+
+	h.UseOutbound(func(next hail.Handler) hail.Handler {
+		return func(s *hail.Session, mt hail.MessageType, msg []byte) error {
+			return next(s, mt, bytes.ToUpper(msg))
+		}
+	})
+	sent := make(chan string, 1)
+	h.HandleSentMessage(func(s *hail.Session, msg []byte) {
+		sent <- string(msg)
+	})
+
+	c := srv.Dial(t)
+	c.Send("hello")
+	c.Expect("HELLO")
+
+	select {
+	case got := <-sent:
+		if got != "HELLO" {
+			t.Fatalf("HandleSentMessage got %q, want HELLO", got)
+		}
+	case <-time.After(hailtest.DefaultTimeout):
+		t.Fatal("HandleSentMessage not fired")
+	}
+}
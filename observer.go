@@ -0,0 +1,121 @@
+package hail
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Observer receives the events of a Hail instance, such as the collector of the metrics package.
+// Its methods are called on the hot path and must not block.
+type Observer interface {
+	// SessionConnected is called once a session is registered.
+	SessionConnected(s *Session)
+	// SessionDisconnected is called once a session is closed, with the cause of the disconnection.
+	SessionDisconnected(s *Session, info DisconnectInfo)
+	// MessageReceived is called for every text and binary message read from a session.
+	MessageReceived(s *Session, t MessageType, size int)
+	// MessageSent is called for every text and binary message written to a session, with how long
+	// the write took and how many messages were still waiting in the output buffer.
+	MessageSent(s *Session, t MessageType, size int, latency time.Duration, queued int)
+	// MessageDropped is called for every message dropped with ErrSessionMessageBufferIsFull.
+	MessageDropped(s *Session)
+	// Fanout is called for every broadcast ("broadcast") and topic publish ("publish"),
+	// with the number of local sessions it reached.
+	Fanout(kind string, recipients int)
+	// PingRTT is called for every pong answering a ping, with the round trip time.
+	PingRTT(s *Session, rtt time.Duration)
+}
+
+// observers 註冊的 Observer，寫入時複製 (the registered observers, copied on write)
+type observers struct {
+	mutex sync.Mutex
+	list  atomic.Value // []Observer
+}
+
+func (o *observers) add(observer Observer) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	list, _ := o.list.Load().([]Observer)
+	o.list.Store(append(list[:len(list):len(list)], observer))
+}
+
+func (o *observers) load() []Observer {
+	list, _ := o.list.Load().([]Observer)
+	return list
+}
+
+func (o *observers) sessionConnected(s *Session) {
+	for _, observer := range o.load() {
+		observer.SessionConnected(s)
+	}
+}
+
+func (o *observers) sessionDisconnected(s *Session, info DisconnectInfo) {
+	for _, observer := range o.load() {
+		observer.SessionDisconnected(s, info)
+	}
+}
+
+func (o *observers) messageReceived(s *Session, t MessageType, size int) {
+	for _, observer := range o.load() {
+		observer.MessageReceived(s, t, size)
+	}
+}
+
+func (o *observers) messageSent(s *Session, t MessageType, size int, latency time.Duration, queued int) {
+	for _, observer := range o.load() {
+		observer.MessageSent(s, t, size, latency, queued)
+	}
+}
+
+func (o *observers) messageDropped(s *Session) {
+	for _, observer := range o.load() {
+		observer.MessageDropped(s)
+	}
+}
+
+func (o *observers) fanout(kind string, recipients int) {
+	for _, observer := range o.load() {
+		observer.Fanout(kind, recipients)
+	}
+}
+
+func (o *observers) pingRTT(s *Session, rtt time.Duration) {
+	for _, observer := range o.load() {
+		observer.PingRTT(s, rtt)
+	}
+}
+
+// Observe registers o to receive the events of h.
+func (h *Hail) Observe(o Observer) {
+	h.observers.add(o)
+}
+
+// TopicStats is a snapshot of the pub/sub register.
+type TopicStats struct {
+	Topics        int // topics with at least one subscriber
+	Subscriptions int // subscriptions over every topic
+}
+
+// TopicStats returns the number of topics and subscriptions of the local node.
+func (h *Hail) TopicStats() TopicStats {
+	return h.pubSub.Stats()
+}
+
+// pingPayload ping 帶上送出的時間，pong 回傳時計算往返時間 (a ping carries the time it was sent, the pong answers it back)
+func pingPayload() []byte {
+	return strconv.AppendInt(nil, time.Now().UnixNano(), 10)
+}
+
+// pingRTT 由 pong 的內容計算往返時間 (the round trip time of a pong answering a ping)
+func pingRTT(payload string) (time.Duration, bool) {
+	sent, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Since(time.Unix(0, sent)), true
+}
@@ -1,6 +1,7 @@
 package hail
 
 import (
+	"log/slog"
 	"net/http"
 	"time"
 )
@@ -12,6 +13,29 @@ type Option struct {
 	PongWait             time.Duration // Timeout for waiting on pong.
 	PingPeriod           time.Duration // Milliseconds between pings.
 	CloseSessionWaitTime time.Duration // Timeout for close session
+	SlowConsumerPolicy   SlowConsumerPolicy
+	SlowConsumerTimeout  time.Duration // How long BlockWithTimeout waits for room in the output buffer.
+	ResumeGrace          time.Duration // How long a dropped session can be resumed, 0 disables resumption.
+	ResumeQueryParam     string        // Query parameter carrying the resume token.
+	ResumeHeader         string        // Header carrying the resume token, also set on the upgrade response.
+	Backplane            Backplane     // Connects the nodes of a cluster, nil keeps messages local.
+	Codec                Codec         // Encodes WriteValue and BroadcastValue, decodes HandleTyped.
+	AckEvents            bool          // Acknowledge the envelopes of On handlers that carry an id with an empty reply.
+	// Authenticate runs before the upgrade. The identity is attached to the session and the keys are
+	// added to Session.Keys. An error rejects the connection, with the status of an AuthError or 401.
+	Authenticate     func(r *http.Request) (Identity, map[string]interface{}, error)
+	RateLimit        RateLimit // Inbound limit of every session, Session.SetRateLimit overrides it.
+	MaxSessions      int       // Sessions accepted at once, over it connections are rejected with 503. 0 is unlimited.
+	MaxSessionsPerIP int       // Sessions accepted at once from a client IP, over it connections are rejected with 429.
+	// MaxSessionsPerKey returns a key, such as the user ID, and how many sessions it can hold at once.
+	// Over it connections are rejected with 429, or the oldest session of the key is closed with EvictOldest.
+	MaxSessionsPerKey func(r *http.Request, identity Identity) (key string, limit int)
+	EvictOldest       bool         // Close the oldest session of a key instead of rejecting the new one.
+	TrustedProxies    []string     // IPs or CIDRs whose ClientIPHeader is trusted.
+	ClientIPHeader    string       // The client address header the trusted proxies set, defaults to X-Forwarded-For. See Session.ClientIP.
+	Tracer            Tracer       // Starts the spans of the message lifecycle, defaults to NopTracer.
+	Logger            *slog.Logger // Structured logs, defaults to discarding them.
+	Clock             Clock        // Drives pings, PongWait, ResumeGrace, retention and rate limits, defaults to the system time. See hailtest.Clock.
 }
 
 func (o *Option) getDefault() *Option {
@@ -22,6 +46,15 @@ func (o *Option) getDefault() *Option {
 		ChannelBufferSize:    1024 * 4,
 		CloseSessionWaitTime: 3 * time.Second,
 		CheckOrigin:          nil,
+		SlowConsumerPolicy:   DropNewest,
+		SlowConsumerTimeout:  time.Second,
+		ResumeQueryParam:     "resume_token",
+		ResumeHeader:         "X-Hail-Resume-Token",
+		ClientIPHeader:       "X-Forwarded-For",
+		Codec:                JSONCodec,
+		Tracer:               NopTracer{},
+		Logger:               slog.New(discardHandler{}),
+		Clock:                realClock{},
 	}
 }
 
@@ -48,6 +81,38 @@ func (o *Option) reset() {
 		o.ChannelBufferSize = defaultOptions.ChannelBufferSize
 	}
 
+	if o.SlowConsumerTimeout == 0 {
+		o.SlowConsumerTimeout = defaultOptions.SlowConsumerTimeout
+	}
+
+	if o.ResumeQueryParam == "" {
+		o.ResumeQueryParam = defaultOptions.ResumeQueryParam
+	}
+
+	if o.ResumeHeader == "" {
+		o.ResumeHeader = defaultOptions.ResumeHeader
+	}
+
+	if o.ClientIPHeader == "" {
+		o.ClientIPHeader = defaultOptions.ClientIPHeader
+	}
+
+	if o.Codec == nil {
+		o.Codec = defaultOptions.Codec
+	}
+
+	if o.Clock == nil {
+		o.Clock = defaultOptions.Clock
+	}
+
+	if o.Logger == nil {
+		o.Logger = defaultOptions.Logger
+	}
+
+	if o.Tracer == nil {
+		o.Tracer = defaultOptions.Tracer
+	}
+
 	if o.CheckOrigin == nil {
 		o.CheckOrigin = defaultOptions.CheckOrigin
 	}
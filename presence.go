@@ -0,0 +1,120 @@
+package hail
+
+import (
+	"encoding/json"
+	"github.com/lesismal/nbio/nbhttp/websocket"
+	"sync"
+)
+
+// TopicPresenceEvent is published, as JSON, to a topic configured with TopicOptions.Presence
+// when a session subscribes to it, unsubscribes from it or disconnects.
+type TopicPresenceEvent struct {
+	Event   string `json:"event"` // "join" or "leave"
+	Topic   string `json:"topic"`
+	Session string `json:"session"`
+	User    string `json:"user,omitempty"`
+}
+
+type handleTopicPresenceFunc func(*Session, string, bool)
+
+// topicChange 一個Session加入或離開topic (a session joined or left a topic)
+type topicChange struct {
+	topic      string
+	s          *Session
+	joined     bool
+	event      *box       // 要發布的 TopicPresenceEvent，沒有開啟 Presence 時為nil (the TopicPresenceEvent to publish, nil without Presence)
+	recipients []*Session // event 的接收者，在指令迴圈中取得 (the sessions receiving event, looked up by the command loop)
+}
+
+// presenceQueue 依序在另一個 goroutine 送出 TopicPresenceEvent 並呼叫 HandleTopicPresence，緩衝區已滿時的回呼不會卡住指令迴圈
+// (queues the TopicPresenceEvents and calls HandleTopicPresence in order from another goroutine, so the callbacks of a full buffer
+// never block the command loop)
+type presenceQueue struct {
+	mutex   sync.Mutex
+	changes []topicChange
+	signal  chan struct{}
+}
+
+func (q *presenceQueue) push(changes []topicChange) {
+	q.mutex.Lock()
+	q.changes = append(q.changes, changes...)
+	q.mutex.Unlock()
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (q *presenceQueue) run(fn func(topicChange), done chan struct{}) {
+	for {
+		select {
+		case <-q.signal:
+		case <-done:
+			return
+		}
+
+		q.mutex.Lock()
+		changes := q.changes
+		q.changes = nil
+		q.mutex.Unlock()
+
+		for _, change := range changes {
+			for _, s := range change.recipients {
+				s.queue(change.event, 0)
+			}
+			fn(change)
+		}
+	}
+}
+
+// notify 取得加入與離開事件的接收者，交給 presenceQueue 送出 (look the receivers of the joins and leaves up and hand them to the presenceQueue)
+func (ps *pubSub) notify(reg *register) {
+	if len(reg.changes) == 0 {
+		return
+	}
+
+	for i, change := range reg.changes {
+		if !reg.options[change.topic].Presence {
+			continue
+		}
+
+		event := TopicPresenceEvent{Event: "leave", Topic: change.topic, Session: change.s.hashID, User: change.s.UserID()}
+		if change.joined {
+			event.Event = "join"
+		}
+
+		data, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+
+		reg.changes[i].event = &box{t: websocket.TextMessage, msg: data}
+		for _, s := range reg.subscribers(change.topic) {
+			if s != change.s {
+				reg.changes[i].recipients = append(reg.changes[i].recipients, s)
+			}
+		}
+	}
+
+	ps.presence.push(reg.changes)
+	reg.changes = nil
+}
+
+// HandleTopicPresence fires fn when a session joins (joined is true) or leaves a topic,
+// by subscribing, unsubscribing or disconnecting. The "default" topic every session joins is
+// left out. fn runs on its own goroutine, in order, so it may call TopicMembers and TopicCount.
+func (h *Hail) HandleTopicPresence(fn func(s *Session, topic string, joined bool)) {
+	h.topicPresenceHandler = fn
+}
+
+// TopicMembers returns the sessions subscribed to topic, including wildcard subscriptions matching it.
+// Disconnected sessions waiting to be resumed are not members.
+func (h *Hail) TopicMembers(topic string) []*Session {
+	return h.pubSub.Members(topic)
+}
+
+// TopicCount returns the number of sessions subscribed to topic.
+func (h *Hail) TopicCount(topic string) int {
+	return len(h.pubSub.Members(topic))
+}
@@ -0,0 +1,105 @@
+package hail_test
+
+import (
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/hailtest"
+	"testing"
+	"time"
+)
+
+func TestTopicPresenceCallbackCanCount(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+	h := srv.Hail
+
+	type change struct {
+		topic string
+		count int
+	}
+	changes := make(chan change, 4)
+	h.HandleTopicPresence(func(s *hail.Session, topic string, joined bool) {
+		changes <- change{topic, h.TopicCount(topic)}
+	})
+
+	c := srv.Dial(t)
+	subscribe(c, "room")
+
+	select {
+	case got := <-changes:
+		if got != (change{"room", 1}) {
+			t.Fatalf("got %+v, want room with 1 member", got)
+		}
+	case <-time.After(hailtest.DefaultTimeout):
+		t.Fatal("no presence change")
+	}
+
+	select {
+	case got := <-changes:
+		t.Fatalf("got unexpected %+v", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestParkedSessionIsNotMember(t *testing.T) {
+	srv := newServer(t, &hail.Option{ResumeGrace: time.Minute})
+	h := srv.Hail
+
+	parked := make(chan struct{}, 1)
+	h.HandleDisconnectInfo(func(s *hail.Session, info hail.DisconnectInfo) {
+		if info.Parked {
+			parked <- struct{}{}
+		}
+	})
+
+	c := srv.Dial(t)
+	subscribe(c, "room")
+	if n := h.TopicCount("room"); n != 1 {
+		t.Fatalf("got %d members, want 1", n)
+	}
+
+	c.Drop()
+	<-parked
+
+	if n := h.TopicCount("room"); n != 0 {
+		t.Fatalf("got %d members while parked, want 0", n)
+	}
+}
+
+func TestPresenceEventCallbacksCanCallPubSub(t *testing.T) {
+	srv := newServer(t, &hail.Option{ChannelBufferSize: 1})
+	h := srv.Hail
+	ids := connectID(h)
+	stalled, release := stall(t, h)
+	h.ConfigureTopic("room", hail.TopicOptions{Presence: true})
+
+	counted := make(chan int, 1)
+	h.HandleError(func(s *hail.Session, err error) {
+		select {
+		case counted <- h.TopicCount("room"):
+		default:
+		}
+	})
+
+	a := srv.Dial(t)
+	subscribe(a, "room")
+	s, _ := h.Session(<-ids)
+	s.Write([]byte("stall"))
+	<-stalled
+	s.Write([]byte("fill"))
+
+	b := srv.Dial(t)
+	b.Send("sub:room")
+
+	select {
+	case n := <-counted:
+		if n != 2 {
+			t.Fatalf("TopicCount returned %d from the error handler, want 2", n)
+		}
+	case <-time.After(hailtest.DefaultTimeout):
+		t.Fatal("the error handler did not return, the pubsub loop is blocked")
+	}
+	b.Expect("subscribed")
+
+	release()
+	a.Expect("stall")
+	a.Expect("fill")
+}
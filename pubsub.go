@@ -1,5 +1,11 @@
 package hail
 
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
 type operation int
 
 const (
@@ -17,123 +23,373 @@ const (
 	CloseTopic
 	// ShutDown 此訂閱服務關機 (shutdown this pub/sub service)
 	ShutDown
+	// ConfigureTopic 設定保留訊息 (configure the retention of the topic)
+	ConfigureTopic
+	// Transfer 將訂閱移交給恢復的Session (hand the subscriptions over to a resumed session)
+	Transfer
+	// Members 查詢訂閱者 (look the subscribers of the topic up)
+	Members
+	// Stats 查詢topic與訂閱數量 (count the topics and subscriptions)
+	Stats
 )
 
-// pubSubPattern 集合topic,capacity是容量 (topic set, buffer channel size)
+// defaultTopic 每個Session連線時都會訂閱，不產生加入與離開 (every session subscribes to it on connect, no join or leave is produced)
+const defaultTopic = "default"
+
+// pubSubPattern 集合topic，訂閱者為Session (topic set, subscribers are sessions)
 type pubSub struct {
-	commandChan chan cmd // 接收指令的channel
-	bufferSize  int
+	commandChan chan cmd      // 接收指令的channel
+	done        chan struct{} // 服務結束時關閉 (closed once the service stops)
+	presence    *presenceQueue
+	logger      *slog.Logger
+	clock       Clock
 }
 
 type cmd struct {
 	opCode operation // 指令 (command)
 	topics []string  // 訂閱的主題 (subscribe topics)
-	ch     chan *box // 使用的channel (channel used by subscriber)
+	s      *Session  // 訂閱者 (subscriber)
+	target *Session  // 移交訂閱的對象 (the session receiving the subscriptions of s)
 	msg    *box      // 訊息內文 (msg data)
+
+	options    TopicOptions    // 設定topic時使用 (used by ConfigureTopic)
+	recipients chan []*Session // 發布時回傳訂閱者 (receives the subscribers of a publish)
+	replay     chan []*box     // 訂閱時回傳保留的訊息 (receives the retained messages of a subscribe)
+	stats      chan TopicStats // 回傳 Stats 的結果 (receives the result of Stats)
+}
+
+// PubReport 發布結果 (the outcome of a publish)
+type PubReport struct {
+	Subscribers int // 符合的訂閱者數量 (number of matched subscriptions)
+	Delivered   int // 成功放入輸出緩衝區 (queued on the output buffer of a session)
+	Dropped     int // 被 SlowConsumerPolicy 丟棄或Session已關閉 (dropped by the SlowConsumerPolicy, or the session was closed)
 }
 
-// pubSubNew 創建一個訂閱者模式 (create a new pub/sub pattern)
-func pubSubNew(bufferSize int) *pubSub {
-	ps := &pubSub{make(chan cmd), bufferSize}
+// pubSubNew 創建一個訂閱者模式，onPresence 接收加入與離開 (create a new pub/sub pattern, onPresence receives the joins and leaves)
+func pubSubNew(logger *slog.Logger, clock Clock, onPresence func(topicChange)) *pubSub {
+	ps := &pubSub{make(chan cmd), make(chan struct{}), &presenceQueue{signal: make(chan struct{}, 1)}, logger, clock}
 	go ps.start()
+	go ps.presence.run(onPresence, ps.done)
 	return ps
 }
 
-// Sub 創建一個新的訂閱頻道, 並將channel回傳 (create a channel for subscribe topic, and return it)
-func (ps *pubSub) Sub(topics ...string) chan *box {
-	return ps.sub(Subscribe, topics...)
+// send 送出指令，服務已關閉時回傳false (send a command, returns false once the service is shut down)
+func (ps *pubSub) send(c cmd) bool {
+	select {
+	case ps.commandChan <- c:
+		return true
+	case <-ps.done:
+		return false
+	}
 }
 
-func (ps *pubSub) sub(op operation, topics ...string) chan *box {
-	ch := make(chan *box, ps.bufferSize)
-	ps.commandChan <- cmd{opCode: op, topics: topics, ch: ch}
-	return ch
+// AddSub 將要訂閱的Topic加到Session，保留的訊息由呼叫端送出，緩衝區已滿時的回呼不會卡住指令迴圈
+// (subscribe the session to topics; the retained messages are queued on the caller, so the callbacks of a full buffer never block the command loop)
+func (ps *pubSub) AddSub(s *Session, topics ...string) {
+	c := cmd{opCode: Subscribe, topics: topics, s: s, replay: make(chan []*box, 1)}
+	if !ps.send(c) {
+		return
+	}
+
+	select {
+	case replay := <-c.replay:
+		for _, m := range replay {
+			s.queue(m, 0)
+		}
+	case <-ps.done:
+	}
 }
 
-// AddSub 將要訂閱的Topic加到現有的channel (add topics into the subscribe channel)
-func (ps *pubSub) AddSub(ch chan *box, topics ...string) {
-	ps.commandChan <- cmd{opCode: Subscribe, topics: topics, ch: ch}
+// Pub 發布訊息 (publish message to subscribers)
+func (ps *pubSub) Pub(msg *box, topics ...string) PubReport {
+	report, _ := ps.publish(msg, Publish, time.Time{}, topics)
+	return report
 }
 
-// Pub 發布訊息 (publish message to subscribe channels)
-func (ps *pubSub) Pub(msg *box, topics ...string) {
-	ps.commandChan <- cmd{opCode: Publish, topics: topics, msg: msg}
+// AsyncPub 非同步的發布訊息，不會等待緩衝區 (async publish message to subscribers, never waits for buffer room)
+func (ps *pubSub) AsyncPub(msg *box, topics ...string) PubReport {
+	report, _ := ps.publish(msg, AsyncPublish, time.Time{}, topics)
+	return report
 }
 
-// AsyncPub 非同步的發布訊息，內部機制 (async publish message to subscribe channels)
-func (ps *pubSub) AsyncPub(msg *box, topics ...string) {
-	ps.commandChan <- cmd{opCode: AsyncPublish, topics: topics, msg: msg}
+// PubWithReport 發布訊息並回傳結果，超過 timeout 回傳 ErrPublishTimeout
+// (publish message and report the outcome, returns ErrPublishTimeout once timeout elapses)
+func (ps *pubSub) PubWithReport(msg *box, timeout time.Duration, topics ...string) (PubReport, error) {
+	return ps.publish(msg, Publish, time.Now().Add(timeout), topics)
+}
+
+// publish 由指令迴圈查出訂閱者，再由呼叫端送出，慢速的訂閱者不會卡住指令迴圈
+// (the command loop only looks the subscribers up, delivery happens on the caller, so a slow subscriber never blocks the loop)
+func (ps *pubSub) publish(msg *box, op operation, deadline time.Time, topics []string) (PubReport, error) {
+	var report PubReport
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	c := cmd{opCode: op, topics: topics, msg: msg, recipients: make(chan []*Session, 1)}
+	select {
+	case ps.commandChan <- c:
+	case <-ps.done:
+		return report, ErrClose
+	case <-timeout:
+		return report, ErrPublishTimeout
+	}
+
+	var recipients []*Session
+	select {
+	case recipients = <-c.recipients:
+	case <-ps.done:
+		return report, ErrClose
+	case <-timeout:
+		return report, ErrPublishTimeout
+	}
+
+	report.Subscribers = len(recipients)
+	if len(recipients) == 0 {
+		return report, nil
+	}
+
+	option := recipients[0].hail.Option
+	block := op == Publish && option.SlowConsumerPolicy == BlockWithTimeout
+
+	// 先不等待地送出，只有放不進去的Session需要等待 (offer without waiting first, only the sessions without room wait)
+	var slow []*Session
+	for _, s := range recipients {
+		if block && !s.closed() {
+			if !s.tryQueue(msg) {
+				slow = append(slow, s)
+				continue
+			}
+		} else if s.queue(msg, 0) != nil {
+			report.Dropped++
+			continue
+		}
+		report.Delivered++
+	}
+
+	if len(slow) == 0 {
+		return report, nil
+	}
+
+	// 所有慢速的Session同時等待同一個期限 (the slow sessions wait together, against one deadline)
+	end := time.Now().Add(option.SlowConsumerTimeout)
+	if !deadline.IsZero() && deadline.Before(end) {
+		end = deadline
+	}
+
+	results := make([]error, len(slow))
+	var wg sync.WaitGroup
+	for i, s := range slow {
+		wg.Add(1)
+		go func(i int, s *Session) {
+			defer wg.Done()
+			results[i] = s.queue(msg, time.Until(end))
+		}(i, s)
+	}
+	wg.Wait()
+
+	for _, err := range results {
+		if err != nil {
+			report.Dropped++
+		} else {
+			report.Delivered++
+		}
+	}
+
+	if report.Dropped > 0 && end.Equal(deadline) {
+		return report, ErrPublishTimeout
+	}
+
+	return report, nil
 }
 
 // Unsub 取消訂閱  (unsubscribe topic, if topics is null, it will unsubscribe all)
-func (ps *pubSub) Unsub(ch chan *box, topics ...string) {
+func (ps *pubSub) Unsub(s *Session, topics ...string) {
 	// 如果不寫topic，視為將全部topic都取消訂閱
 	if len(topics) == 0 {
-		ps.commandChan <- cmd{opCode: UnSubscribeAll, ch: ch}
+		ps.send(cmd{opCode: UnSubscribeAll, s: s})
 		return
 	}
 
-	ps.commandChan <- cmd{opCode: Unsubscribe, topics: topics, ch: ch}
+	ps.send(cmd{opCode: Unsubscribe, topics: topics, s: s})
 }
 
-// Close 關閉Topic, 相關有訂閱的channel都會被取消 (close topics, if channel subscribe it, will auto unsubscribe)
+// Close 關閉Topic, 相關有訂閱的Session都會被取消 (close topics, subscribed sessions will auto unsubscribe)
 func (ps *pubSub) Close(topics ...string) {
-	ps.commandChan <- cmd{opCode: CloseTopic, topics: topics}
+	ps.send(cmd{opCode: CloseTopic, topics: topics})
+}
+
+// Members 回傳訂閱符合topic的Session (return the sessions whose subscription matches topic)
+func (ps *pubSub) Members(topic string) []*Session {
+	c := cmd{opCode: Members, topics: []string{topic}, recipients: make(chan []*Session, 1)}
+	if !ps.send(c) {
+		return nil
+	}
+
+	select {
+	case members := <-c.recipients:
+		return members
+	case <-ps.done:
+		return nil
+	}
 }
 
-// Shutdown 關閉所有有訂閱的Channel (close all channels)
+// Stats 回傳topic與訂閱數量 (return the number of topics and subscriptions)
+func (ps *pubSub) Stats() TopicStats {
+	c := cmd{opCode: Stats, stats: make(chan TopicStats, 1)}
+	if !ps.send(c) {
+		return TopicStats{}
+	}
+
+	select {
+	case stats := <-c.stats:
+		return stats
+	case <-ps.done:
+		return TopicStats{}
+	}
+}
+
+// Transfer 將 from 的訂閱移交給 to (hand the subscriptions of from over to to)
+func (ps *pubSub) Transfer(from, to *Session) {
+	ps.send(cmd{opCode: Transfer, s: from, target: to})
+}
+
+// Configure 設定topic保留的訊息 (configure the messages retained for topic)
+func (ps *pubSub) Configure(topic string, options TopicOptions) {
+	ps.send(cmd{opCode: ConfigureTopic, topics: []string{topic}, options: options})
+}
+
+// Shutdown 取消所有訂閱並結束服務 (unsubscribe everyone and stop the service)
 func (ps *pubSub) Shutdown() {
-	ps.commandChan <- cmd{opCode: ShutDown}
+	ps.send(cmd{opCode: ShutDown})
 }
 
 func (ps *pubSub) start() {
+	defer close(ps.done)
 
 	// 初始化暫存在記憶體的資料(topicsMap & revertTopicsOfChannelMap)
 	// init register data
 	reg := register{
-		topics:    make(map[string]map[chan *box]bool),
-		revTopics: make(map[chan *box]map[string]bool),
+		topics:    make(map[string]map[*Session]bool),
+		revTopics: make(map[*Session]map[string]bool),
+		trie:      newTopicNode(),
+		retained:  make(map[string]*retention),
+		options:   make(map[string]TopicOptions),
+		clock:     ps.clock,
 	}
 
-loop:
 	for cmd := range ps.commandChan {
-		if cmd.topics == nil {
-			switch cmd.opCode {
-			case UnSubscribeAll:
-				reg.removeChannel(cmd.ch)
+		if !ps.handle(&reg, cmd) {
+			break
+		}
+		ps.notify(&reg)
+	}
 
-			case ShutDown:
-				break loop
+	// 當跳出迴圈要結束時，將所有訂閱移除
+	// while break loop, remove all subscriptions ,release all
+	for topic, sessions := range reg.topics {
+		for s := range sessions {
+			reg.remove(topic, s)
+		}
+	}
+}
+
+// handle 執行一個指令，收到 ShutDown 時回傳false (run one command, returns false on ShutDown)
+func (ps *pubSub) handle(reg *register, cmd cmd) bool {
+	switch cmd.opCode {
+	case Publish, AsyncPublish:
+		// 訂閱多個發布topic的Session只收到一次 (a session subscribed to several of the topics receives the message once)
+		found := make(map[*Session]bool)
+		recipients := make([]*Session, 0)
+		for _, topic := range cmd.topics {
+			for _, s := range reg.subscribers(topic) {
+				if !found[s] {
+					found[s] = true
+					recipients = append(recipients, s)
+				}
 			}
+			reg.retain(topic, cmd.msg)
+		}
+		cmd.recipients <- recipients
+
+		return true
 
-			continue loop
+	case Members:
+		// 等待恢復的Session已斷線，不算成員 (a parked session is disconnected, it is not a member)
+		members := make([]*Session, 0)
+		for _, s := range reg.subscribers(cmd.topics[0]) {
+			if !s.closed() {
+				members = append(members, s)
+			}
 		}
+		cmd.recipients <- members
 
-		for _, topic := range cmd.topics {
-			switch cmd.opCode {
-			case Subscribe:
-				reg.add(topic, cmd.ch)
+		return true
+
+	case Subscribe:
+		var replay []*box
+		// 已關閉的Session不再訂閱 (a closed session must not subscribe again)
+		if !cmd.s.closed() {
+			for _, topic := range cmd.topics {
+				reg.add(topic, cmd.s)
+				replay = append(replay, reg.replay(topic)...)
+				cmd.s.logger.Debug("topic subscribed", logTopic, topic)
+			}
+		}
+		cmd.replay <- replay
 
-			case Publish:
-				reg.send(topic, cmd.msg)
+		return true
 
-			case AsyncPublish:
-				reg.sendAsync(topic, cmd.msg)
+	case Stats:
+		stats := TopicStats{Topics: len(reg.topics)}
+		for _, sessions := range reg.topics {
+			stats.Subscriptions += len(sessions)
+		}
+		cmd.stats <- stats
 
-			case Unsubscribe:
-				reg.remove(topic, cmd.ch)
+		return true
+	}
 
-			case CloseTopic:
-				reg.removeTopic(topic)
+	if cmd.topics == nil {
+		switch cmd.opCode {
+		case UnSubscribeAll:
+			reg.removeSession(cmd.s)
+
+		case Transfer:
+			if cmd.target.closed() {
+				reg.removeSession(cmd.s)
+			} else {
+				reg.transfer(cmd.s, cmd.target)
 			}
+
+		case ShutDown:
+			ps.logger.Info("pubsub shut down", "topics", len(reg.topics))
+			return false
 		}
+
+		return true
 	}
 
-	// 當跳出迴圈要結束時，將所有未關閉的topic channel進行移除
-	// while break loop, close all topic channel ,release all
-	for topic, chans := range reg.topics {
-		for ch := range chans {
-			reg.remove(topic, ch)
+	for _, topic := range cmd.topics {
+		switch cmd.opCode {
+		case Unsubscribe:
+			reg.remove(topic, cmd.s)
+			cmd.s.logger.Debug("topic unsubscribed", logTopic, topic)
+
+		case CloseTopic:
+			ps.logger.Debug("topic closed", logTopic, topic, "subscribers", len(reg.topics[topic]))
+			reg.removeTopic(topic)
+
+		case ConfigureTopic:
+			reg.configure(topic, cmd.options)
+			ps.logger.Debug("topic configured", logTopic, topic, "retain", cmd.options.Retain,
+				"retain_for", cmd.options.RetainFor, "presence", cmd.options.Presence)
 		}
 	}
+
+	return true
 }
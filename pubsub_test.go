@@ -0,0 +1,57 @@
+package hail_test
+
+import (
+	"github.com/lishank0119/hail"
+	"testing"
+	"time"
+)
+
+func TestPublishDeliversOncePerSession(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+
+	c := srv.Dial(t)
+	subscribe(c, "a")
+	subscribe(c, "b")
+
+	report, err := srv.Hail.PubTextMsgWithReport([]byte("news"), time.Second, "a", "b")
+	if err != nil || report.Subscribers != 1 || report.Delivered != 1 {
+		t.Fatalf("got %+v, %v, want one delivery", report, err)
+	}
+
+	c.Expect("news")
+	c.ExpectNothing(50 * time.Millisecond)
+}
+
+func TestPublishWaitsForSlowSessionsTogether(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+
+	srv := newServer(t, &hail.Option{
+		ChannelBufferSize:   1,
+		SlowConsumerPolicy:  hail.BlockWithTimeout,
+		SlowConsumerTimeout: timeout,
+	})
+	h := srv.Hail
+	ids := connectID(h)
+	stalled, _ := stall(t, h)
+
+	for i := 0; i < 2; i++ {
+		c := srv.Dial(t)
+		id := <-ids
+		subscribe(c, "room")
+
+		h.SendTo(id, []byte("stall"))
+		<-stalled
+		h.SendTo(id, []byte("fill"))
+	}
+
+	start := time.Now()
+	report, err := h.PubTextMsgWithReport([]byte("news"), 5*time.Second, "room")
+	elapsed := time.Since(start)
+
+	if err != nil || report.Subscribers != 2 || report.Dropped != 2 {
+		t.Fatalf("got %+v, %v, want both dropped", report, err)
+	}
+	if elapsed < timeout || elapsed >= 2*timeout {
+		t.Fatalf("publish took %s, want about %s", elapsed, timeout)
+	}
+}
@@ -0,0 +1,276 @@
+package hail
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitPolicy 超過速率限制時的處理方式 (what happens to a message over the rate limit)
+type RateLimitPolicy int
+
+const (
+	// RateLimitDrop 丟棄訊息 (drop the message)
+	RateLimitDrop RateLimitPolicy = iota
+	// RateLimitDelay 等到額度足夠再處理 (wait until the bucket has room, then handle the message)
+	// Delayed messages are handled in order without holding up the reads of the session. A
+	// message that would wait longer than it takes to refill a full burst is dropped and
+	// reported with Policy RateLimitDrop.
+	RateLimitDelay
+	// RateLimitErrorEvent 丟棄訊息並送出 {"event":"error","error":"..."} (drop the message and send an error event)
+	RateLimitErrorEvent
+	// RateLimitClose 以 1008 關閉連線 (close the session with 1008)
+	RateLimitClose
+)
+
+func (p RateLimitPolicy) String() string {
+	switch p {
+	case RateLimitDrop:
+		return "drop"
+	case RateLimitDelay:
+		return "delay"
+	case RateLimitErrorEvent:
+		return "error_event"
+	case RateLimitClose:
+		return "close"
+	}
+
+	return "unknown"
+}
+
+// RateLimit limits the inbound text and binary messages of a session with token buckets.
+// A zero rate leaves that dimension unlimited.
+type RateLimit struct {
+	Messages   float64 // messages per second
+	Bytes      float64 // bytes per second
+	Burst      int     // messages allowed at once, defaults to Messages
+	BurstBytes int     // bytes allowed at once, defaults to Bytes
+	Policy     RateLimitPolicy
+}
+
+// RateLimitError is reported through HandleError for every message over the rate limit.
+type RateLimitError struct {
+	Limit  string          // "messages" or "bytes"
+	Policy RateLimitPolicy // what was done with the message
+	Wait   time.Duration   // how long until the message fits in the bucket
+}
+
+func (e *RateLimitError) Error() string {
+	return "rate limit exceeded: " + e.Limit + ", " + e.Policy.String() + " (retry in " + strconv.FormatInt(e.Wait.Milliseconds(), 10) + "ms)"
+}
+
+// bucket token bucket
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+}
+
+func newBucket(rate float64, burst int) bucket {
+	b := bucket{rate: rate, burst: float64(burst)}
+	if b.burst <= 0 {
+		b.burst = rate
+	}
+	if b.burst < 1 {
+		b.burst = 1
+	}
+	b.tokens = b.burst
+
+	return b
+}
+
+func (b *bucket) refill(elapsed time.Duration) {
+	if b.rate <= 0 {
+		return
+	}
+
+	b.tokens += elapsed.Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// wait 取得 n 個token前需要等待的時間 (how long until n tokens are available)
+func (b *bucket) wait(n float64) time.Duration {
+	if b.rate <= 0 || b.tokens >= n {
+		return 0
+	}
+
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// rateLimiter 每個Session的訊息數與位元組數限制 (the message and byte limits of a session)
+type rateLimiter struct {
+	mutex    sync.Mutex
+	clock    Clock
+	limit    RateLimit
+	messages bucket
+	bytes    bucket
+	last     time.Time
+}
+
+func newRateLimiter(limit RateLimit, clock Clock) *rateLimiter {
+	return &rateLimiter{
+		clock:    clock,
+		limit:    limit,
+		messages: newBucket(limit.Messages, limit.Burst),
+		bytes:    newBucket(limit.Bytes, limit.BurstBytes),
+		last:     clock.Now(),
+	}
+}
+
+// reserve 取得一則 size 位元組訊息的額度，超過限制時回傳錯誤。RateLimitDelay 會預支額度，呼叫端等待 Wait 後再處理
+// (take the tokens of a message of size bytes, returns an error when over the limit. RateLimitDelay borrows the
+// tokens and the caller waits Wait before handling the message)
+func (l *rateLimiter) reserve(size int) *RateLimitError {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.limit.Messages <= 0 && l.limit.Bytes <= 0 {
+		return nil
+	}
+
+	now := l.clock.Now()
+	l.messages.refill(now.Sub(l.last))
+	l.bytes.refill(now.Sub(l.last))
+	l.last = now
+
+	var err *RateLimitError
+	if wait := l.messages.wait(1); wait > 0 {
+		err = &RateLimitError{Limit: "messages", Policy: l.limit.Policy, Wait: wait}
+	}
+	if wait := l.bytes.wait(float64(size)); wait > 0 && (err == nil || wait > err.Wait) {
+		err = &RateLimitError{Limit: "bytes", Policy: l.limit.Policy, Wait: wait}
+	}
+
+	// 預支最多一個 burst，超過就丟棄 (borrow at most one burst, drop beyond it)
+	if err != nil && l.limit.Policy == RateLimitDelay && !l.canBorrow(size) {
+		err.Policy = RateLimitDrop
+	}
+
+	if err == nil || err.Policy == RateLimitDelay {
+		if l.limit.Messages > 0 {
+			l.messages.tokens--
+		}
+		if l.limit.Bytes > 0 {
+			l.bytes.tokens -= float64(size)
+		}
+	}
+
+	return err
+}
+
+// canBorrow 預支後的欠額是否不超過一個 burst，必須持有 mutex (whether the debt after borrowing stays within one burst; mutex must be held)
+func (l *rateLimiter) canBorrow(size int) bool {
+	if l.limit.Messages > 0 && l.messages.tokens-1 < -l.messages.burst {
+		return false
+	}
+
+	if l.limit.Bytes > 0 && l.bytes.tokens-float64(size) < -l.bytes.burst {
+		return false
+	}
+
+	return true
+}
+
+// delayed 因 RateLimitDelay 延後處理的訊息 (messages held back by RateLimitDelay)
+type delayed struct {
+	mutex    sync.Mutex
+	messages []delayedMessage
+	running  bool // 有排定的 flush (a flush is scheduled or running)
+}
+
+type delayedMessage struct {
+	t   MessageType
+	msg []byte
+	at  time.Time // 可以處理的時間 (when the message may be handled)
+}
+
+// SetRateLimit overrides Option.RateLimit for this session, such as for premium users.
+func (s *Session) SetRateLimit(limit RateLimit) {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	s.limiter = newRateLimiter(limit, s.hail.Option.Clock)
+}
+
+// admit 依速率限制處理收到的訊息，延後的訊息依序由 Clock 排定處理 (handle an inbound message under the rate limit, delayed ones are scheduled in order on the Clock)
+func (s *Session) admit(t MessageType, msg []byte) {
+	wait, ok := s.allow(len(msg))
+	if !ok {
+		return
+	}
+
+	d := s.delayed
+	d.mutex.Lock()
+	// 已有延後的訊息時要排在後面 (queue behind the messages already delayed)
+	if !d.running && wait == 0 {
+		d.mutex.Unlock()
+		s.handOff(t, msg)
+		return
+	}
+
+	d.messages = append(d.messages, delayedMessage{t: t, msg: msg, at: s.hail.Option.Clock.Now().Add(wait)})
+	start := !d.running
+	d.running = true
+	d.mutex.Unlock()
+
+	if start {
+		s.hail.Option.Clock.AfterFunc(wait, s.flushDelayed)
+	}
+}
+
+// flushDelayed 處理到期的延後訊息，再排定下一則 (handle the delayed messages that are due, then schedule the next one)
+func (s *Session) flushDelayed() {
+	d := s.delayed
+
+	for {
+		d.mutex.Lock()
+		if len(d.messages) == 0 || s.closed() {
+			d.messages = nil
+			d.running = false
+			d.mutex.Unlock()
+			return
+		}
+
+		m := d.messages[0]
+		if wait := m.at.Sub(s.hail.Option.Clock.Now()); wait > 0 {
+			d.mutex.Unlock()
+			s.hail.Option.Clock.AfterFunc(wait, s.flushDelayed)
+			return
+		}
+		d.messages = d.messages[1:]
+		d.mutex.Unlock()
+
+		s.handOff(m.t, m.msg)
+	}
+}
+
+// allow 檢查速率限制，回傳false時不處理這則訊息，wait 是 RateLimitDelay 延後的時間
+// (check the rate limit, the message is not handled when it returns false, wait is the delay of RateLimitDelay)
+func (s *Session) allow(size int) (wait time.Duration, ok bool) {
+	s.rwMutex.RLock()
+	limiter := s.limiter
+	s.rwMutex.RUnlock()
+
+	err := limiter.reserve(size)
+	if err == nil {
+		return 0, true
+	}
+
+	s.logger.Warn("rate limit exceeded", "limit", err.Limit, "policy", err.Policy.String(), "wait", err.Wait)
+	s.hail.errorHandler(s, err)
+
+	switch err.Policy {
+	case RateLimitDelay:
+		return err.Wait, true
+
+	case RateLimitErrorEvent:
+		s.reply(&Envelope{Event: "error", Error: err.Error()})
+
+	case RateLimitClose:
+		s.CloseWithReason(ClosePolicyViolation, "rate limit exceeded")
+	}
+
+	return 0, false
+}
@@ -0,0 +1,105 @@
+package hail_test
+
+import (
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/hailtest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitRefillFollowsClock(t *testing.T) {
+	clock := hailtest.NewClock()
+	srv := newServer(t, &hail.Option{
+		Clock:     clock,
+		RateLimit: hail.RateLimit{Messages: 1, Burst: 1, Policy: hail.RateLimitErrorEvent},
+	})
+
+	c := srv.Dial(t)
+	c.Send("a")
+	c.Expect("a")
+
+	c.Send("b")
+	if m := c.Next(hailtest.DefaultTimeout); !strings.Contains(string(m.Data), `"event":"error"`) {
+		t.Fatalf("got %q, want an error event", m.Data)
+	}
+
+	clock.Advance(time.Second)
+	c.Send("c")
+	c.Expect("c")
+}
+
+func TestRateLimitDelayIsBounded(t *testing.T) {
+	clock := hailtest.NewClock()
+	srv := newServer(t, &hail.Option{
+		Clock:     clock,
+		RateLimit: hail.RateLimit{Messages: 1, Burst: 1, Policy: hail.RateLimitDelay},
+	})
+
+	limited := make(chan *hail.RateLimitError, 2)
+	srv.Hail.HandleError(func(s *hail.Session, err error) {
+		if rl, ok := err.(*hail.RateLimitError); ok {
+			limited <- rl
+		}
+	})
+
+	c := srv.Dial(t)
+	c.Send("a")
+	c.Expect("a")
+
+	c.Send("b")
+	c.Send("c")
+	if rl := <-limited; rl.Policy != hail.RateLimitDelay {
+		t.Fatalf("b was handled with %s, want delay", rl.Policy)
+	}
+	if rl := <-limited; rl.Policy != hail.RateLimitDrop {
+		t.Fatalf("c was handled with %s, want drop", rl.Policy)
+	}
+	c.ExpectNothing(50 * time.Millisecond)
+
+	clock.BlockUntil(2)
+	clock.Advance(time.Second)
+	c.Expect("b")
+	c.ExpectNothing(50 * time.Millisecond)
+}
+
+func TestSetRateLimitOverridesOption(t *testing.T) {
+	clock := hailtest.NewClock()
+	srv := newServer(t, &hail.Option{Clock: clock})
+	srv.Hail.HandleConnect(func(s *hail.Session) {
+		if s.Request.URL.Query().Get("limited") != "" {
+			s.SetRateLimit(hail.RateLimit{Messages: 1, Burst: 1})
+		}
+	})
+
+	limited := srv.DialWith(t, "limited=1", nil)
+	free := srv.Dial(t)
+
+	limited.Send("a")
+	limited.Expect("a")
+	limited.Send("b")
+	limited.ExpectNothing(50 * time.Millisecond)
+
+	free.Send("a")
+	free.Expect("a")
+	free.Send("b")
+	free.Expect("b")
+
+	clock.Advance(time.Second)
+	limited.Send("c")
+	limited.Expect("c")
+}
+
+func TestRateLimitClose(t *testing.T) {
+	srv := newServer(t, &hail.Option{
+		Clock:     hailtest.NewClock(),
+		RateLimit: hail.RateLimit{Messages: 1, Burst: 1, Policy: hail.RateLimitClose},
+	})
+
+	c := srv.Dial(t)
+	c.Send("a")
+	c.Expect("a")
+
+	c.Send("b")
+	c.ExpectClose(hail.ClosePolicyViolation)
+}
@@ -1,71 +1,149 @@
 package hail
 
+import "strings"
+
 // register
-// topics    Key: topic  , Value: 有訂閱此Topic的ChannelMap
-// revTopics Key: Channel, Value: 訂閱了哪些Topic
+// topics    Key: topic  , Value: 有訂閱此Topic的Session
+// revTopics Key: Session, Value: 訂閱了哪些Topic
+// trie      依層級存放的訂閱，支援 "+" 與 "#" 萬用字元 (subscriptions by level, supports the "+" and "#" wildcards)
+// retained  Key: topic  , Value: 此Topic保留的訊息
+// options   Key: topic  , Value: 此Topic的設定
+// changes   尚未通知的加入與離開 (joins and leaves not notified yet)
+// clock     計算保留時間 (measures the retention time)
 type register struct {
-	topics    map[string]map[chan *box]bool
-	revTopics map[chan *box]map[string]bool
+	topics    map[string]map[*Session]bool
+	revTopics map[*Session]map[string]bool
+	trie      *topicNode
+	retained  map[string]*retention
+	options   map[string]TopicOptions
+	changes   []topicChange
+	clock     Clock
 }
 
-func (reg *register) add(topic string, ch chan *box) {
+func (reg *register) add(topic string, s *Session) {
 	if reg.topics[topic] == nil {
-		reg.topics[topic] = make(map[chan *box]bool)
+		reg.topics[topic] = make(map[*Session]bool)
+	}
+	if !reg.topics[topic][s] && topic != defaultTopic {
+		reg.changes = append(reg.changes, topicChange{topic: topic, s: s, joined: true})
+	}
+	reg.topics[topic][s] = true
+
+	if reg.revTopics[s] == nil {
+		reg.revTopics[s] = make(map[string]bool)
+	}
+	reg.revTopics[s][topic] = true
+
+	reg.trie.insert(splitTopic(topic), s)
+}
+
+// transfer 將 from 的訂閱移交給 to (hand the subscriptions of from over to to)
+// 恢復的Session視為同一個成員，不產生加入與離開 (a resumed session is the same member, no join or leave is produced)
+func (reg *register) transfer(from, to *Session) {
+	changes := len(reg.changes)
+	for topic := range reg.revTopics[from] {
+		reg.remove(topic, from)
+		reg.add(topic, to)
+	}
+	reg.changes = reg.changes[:changes]
+}
+
+// configure 設定topic的保留方式與成員通知 (configure how a topic retains messages and announces its members)
+func (reg *register) configure(topic string, options TopicOptions) {
+	if options == (TopicOptions{}) {
+		delete(reg.options, topic)
+	} else {
+		reg.options[topic] = options
+	}
+
+	if options.Retain <= 0 && options.RetainFor <= 0 {
+		delete(reg.retained, topic)
+		return
 	}
-	reg.topics[topic][ch] = true
 
-	if reg.revTopics[ch] == nil {
-		reg.revTopics[ch] = make(map[string]bool)
+	if r, ok := reg.retained[topic]; ok {
+		r.options = options
+		r.expire(reg.clock.Now())
+		return
 	}
-	reg.revTopics[ch][topic] = true
+
+	reg.retained[topic] = &retention{options: options}
 }
 
-func (reg *register) send(topic string, msg *box) {
-	for ch := range reg.topics[topic] {
-		ch <- msg
+// retain 記錄發布到topic的訊息 (remember a message published to topic)
+func (reg *register) retain(topic string, msg *box) {
+	if r, ok := reg.retained[topic]; ok {
+		r.add(msg, reg.clock.Now())
 	}
 }
 
-func (reg *register) sendAsync(topic string, msg *box) {
-	for ch := range reg.topics[topic] {
-		select {
-		case ch <- msg:
-		default:
+// replay 回傳符合filter的保留訊息，由訂閱的呼叫端送出 (return the messages retained for the topics matching filter, the subscribing caller sends them)
+func (reg *register) replay(filter string) []*box {
+	now := reg.clock.Now()
+
+	if !strings.ContainsAny(filter, singleLevelWildcard+multiLevelWildcard) {
+		if r, ok := reg.retained[filter]; ok {
+			return r.replay(now)
 		}
+		return nil
+	}
 
+	var messages []*box
+	for topic, r := range reg.retained {
+		if matchTopic(filter, topic) {
+			messages = append(messages, r.replay(now)...)
+		}
 	}
+
+	return messages
+}
+
+// subscribers 回傳訂閱符合topic的Session (return the sessions whose subscription matches topic)
+func (reg *register) subscribers(topic string) []*Session {
+	found := make(map[*Session]bool)
+	reg.trie.match(splitTopic(topic), found)
+
+	sessions := make([]*Session, 0, len(found))
+	for s := range found {
+		sessions = append(sessions, s)
+	}
+
+	return sessions
 }
 
 func (reg *register) removeTopic(topic string) {
-	for ch := range reg.topics[topic] {
-		reg.remove(topic, ch)
+	for s := range reg.topics[topic] {
+		reg.remove(topic, s)
 	}
 }
 
-func (reg *register) removeChannel(ch chan *box) {
-	for topic := range reg.revTopics[ch] {
-		reg.remove(topic, ch)
+func (reg *register) removeSession(s *Session) {
+	for topic := range reg.revTopics[s] {
+		reg.remove(topic, s)
 	}
 }
 
-func (reg *register) remove(topic string, ch chan *box) {
+func (reg *register) remove(topic string, s *Session) {
 	if _, ok := reg.topics[topic]; !ok {
 		return
 	}
 
-	if _, ok := reg.topics[topic][ch]; !ok {
+	if _, ok := reg.topics[topic][s]; !ok {
 		return
 	}
 
-	delete(reg.topics[topic], ch)
-	delete(reg.revTopics[ch], topic)
+	delete(reg.topics[topic], s)
+	delete(reg.revTopics[s], topic)
+	reg.trie.remove(splitTopic(topic), s)
+	if topic != defaultTopic {
+		reg.changes = append(reg.changes, topicChange{topic: topic, s: s, joined: false})
+	}
 
 	if len(reg.topics[topic]) == 0 {
 		delete(reg.topics, topic)
 	}
 
-	if len(reg.revTopics[ch]) == 0 {
-		close(ch)
-		delete(reg.revTopics, ch)
+	if len(reg.revTopics[s]) == 0 {
+		delete(reg.revTopics, s)
 	}
 }
@@ -0,0 +1,140 @@
+package hail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+)
+
+// ReplyError is returned by Session.Call when the client answered with an error.
+type ReplyError struct {
+	Event   string
+	Message string
+}
+
+func (e *ReplyError) Error() string {
+	return e.Event + ": " + e.Message
+}
+
+type handleRequestFunc func(*Session, json.RawMessage) (interface{}, error)
+
+// requests 等待客戶端回覆的請求 (requests waiting for a reply from the client)
+type requests struct {
+	mutex   sync.Mutex
+	next    uint64
+	pending map[string]chan *Envelope // Key: id
+}
+
+func newRequests() *requests {
+	return &requests{pending: make(map[string]chan *Envelope)}
+}
+
+// add 登記一個請求並回傳它的id (register a request and return its id)
+func (r *requests) add() (string, chan *Envelope) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.next++
+	id := strconv.FormatUint(r.next, 10)
+	reply := make(chan *Envelope, 1)
+	r.pending[id] = reply
+
+	return id, reply
+}
+
+func (r *requests) remove(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.pending, id)
+}
+
+// resolve 將回覆交給等待的請求，沒有對應的請求時回傳false (hand the reply to the waiting request, returns false when none matches)
+func (r *requests) resolve(envelope *Envelope) bool {
+	id := string(bytes.TrimSpace(envelope.ID))
+
+	r.mutex.Lock()
+	reply, ok := r.pending[id]
+	delete(r.pending, id)
+	r.mutex.Unlock()
+
+	if ok {
+		reply <- envelope
+	}
+
+	return ok
+}
+
+func (r *requests) len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return len(r.pending)
+}
+
+// OnRequest routes the envelopes named event to fn, and answers the ones carrying an id with
+// {"event":event,"id":id,"reply":true,"data":...}, data being the result of fn encoded as JSON.
+// Errors are answered as with On.
+func (h *Hail) OnRequest(event string, fn func(*Session, json.RawMessage) (interface{}, error)) {
+	h.router.add(event, fn, true)
+}
+
+// Call sends payload to the session as an envelope named event with a new id, and waits for
+// the client to answer with {"id":id,"reply":true,"data":...}. It returns the data of the reply,
+// a *ReplyError when the reply carries an error, ErrRequestCanceled when the session closes
+// first, or the error of ctx. It is named Call because Session.Request holds the HTTP request.
+// Replies are resolved as they are read, ahead of the handlers and the inbound middlewares, so Call
+// may be made from a handler of the same session.
+func (s *Session) Call(ctx context.Context, event string, payload interface{}) (json.RawMessage, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	s.hail.router.enable()
+
+	id, reply := s.requests.add()
+	defer s.requests.remove(id)
+
+	envelope := &Envelope{Event: event, ID: json.RawMessage(id), Data: data}
+	if sc := SpanFromContext(ctx); sc.IsValid() {
+		envelope.Trace = &sc
+	}
+
+	if err := s.reply(envelope); err != nil {
+		return nil, err
+	}
+
+	select {
+	case envelope := <-reply:
+		if envelope.Error != "" {
+			return nil, &ReplyError{Event: event, Message: envelope.Error}
+		}
+		return envelope.Data, nil
+	case <-s.outputDone:
+		return nil, ErrRequestCanceled
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolveReply 讀取時就交給等待中的 Call，不是回覆時回傳false (hand a reply to the waiting Call as soon as it is read, returns false when it is not one)
+func (s *Session) resolveReply(msg []byte) bool {
+	if s.requests.len() == 0 {
+		return false
+	}
+
+	var envelope Envelope
+	if json.Unmarshal(msg, &envelope) != nil || !envelope.Reply {
+		return false
+	}
+
+	return s.requests.resolve(&envelope)
+}
+
+// PendingRequests returns the number of Call requests waiting for a reply from the client.
+func (s *Session) PendingRequests() int {
+	return s.requests.len()
+}
@@ -0,0 +1,104 @@
+package hail_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/hailtest"
+	"testing"
+	"time"
+)
+
+func TestCallWaitsForReply(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+	h := srv.Hail
+	ids := connectID(h)
+
+	c := srv.Dial(t)
+	s, _ := h.Session(<-ids)
+
+	type result struct {
+		data json.RawMessage
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		data, err := s.Call(context.Background(), "ask", "meaning")
+		results <- result{data, err}
+	}()
+
+	var envelope hail.Envelope
+	if err := json.Unmarshal(c.Next(hailtest.DefaultTimeout).Data, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Event != "ask" || string(envelope.Data) != `"meaning"` || envelope.ID == nil {
+		t.Fatalf("got %+v", envelope)
+	}
+
+	c.Send(`{"id":` + string(envelope.ID) + `,"reply":true,"data":42}`)
+
+	r := <-results
+	if r.err != nil || string(r.data) != "42" {
+		t.Fatalf("Call returned %s, %v", r.data, r.err)
+	}
+	if n := s.PendingRequests(); n != 0 {
+		t.Fatalf("%d requests still pending", n)
+	}
+}
+
+func TestCallCanceledByClose(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+	h := srv.Hail
+	ids := connectID(h)
+
+	c := srv.Dial(t)
+	s, _ := h.Session(<-ids)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.Call(context.Background(), "ask", nil)
+		errs <- err
+	}()
+
+	c.Next(hailtest.DefaultTimeout)
+	c.Close()
+
+	select {
+	case err := <-errs:
+		if err != hail.ErrRequestCanceled {
+			t.Fatalf("got %v, want ErrRequestCanceled", err)
+		}
+	case <-time.After(hailtest.DefaultTimeout):
+		t.Fatal("Call did not return after the session closed")
+	}
+}
+
+func TestCallFromHandler(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+	h := srv.Hail
+	h.HandleMessage(func(s *hail.Session, msg []byte) {
+		ctx, cancel := context.WithTimeout(context.Background(), hailtest.DefaultTimeout)
+		defer cancel()
+
+		data, err := s.Call(ctx, "ask", string(msg))
+		if err != nil {
+			s.Write([]byte(err.Error()))
+			return
+		}
+		s.Write(data)
+	})
+
+	c := srv.Dial(t)
+	c.Send("meaning")
+
+	var envelope hail.Envelope
+	if err := json.Unmarshal(c.Next(hailtest.DefaultTimeout).Data, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Event != "ask" || string(envelope.Data) != `"meaning"` {
+		t.Fatalf("got %+v", envelope)
+	}
+
+	c.Send(`{"id":` + string(envelope.ID) + `,"reply":true,"data":42}`)
+	c.Expect("42")
+}
@@ -0,0 +1,260 @@
+package hail
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// parking 斷線後等待恢復的狀態 (state kept while a disconnected session waits to be resumed)
+type parking struct {
+	mutex    sync.Mutex
+	messages []*box   // 斷線期間收到的訊息 (messages delivered while disconnected)
+	next     *Session // 恢復後的Session，之後的訊息會轉送給它 (the resumed session, later deliveries are forwarded to it)
+	expired  bool
+	timer    Timer     // 由 Hail.resumeMutex 保護 (guarded by Hail.resumeMutex)
+	deadline time.Time // 超過後放棄恢復 (resumption is given up after it)
+}
+
+// write 暫存或轉送斷線期間的訊息 (buffer or forward a message delivered while parked)
+func (p *parking) write(s *Session, message *box) error {
+	p.mutex.Lock()
+	next, expired := p.next, p.expired
+	if next == nil && !expired {
+		p.buffer(s, message)
+	}
+	p.mutex.Unlock()
+
+	if next != nil {
+		return next.writeMessage(message)
+	}
+
+	if expired {
+		return ErrWriteCloseSession
+	}
+
+	return nil
+}
+
+// buffer 暫存訊息，超過 ChannelBufferSize 時丟棄最舊的；必須持有 mutex
+// (buffer messages, dropping the oldest beyond ChannelBufferSize; mutex must be held)
+func (p *parking) buffer(s *Session, messages ...*box) {
+	p.messages = append(p.messages, messages...)
+	if over := len(p.messages) - s.hail.Option.ChannelBufferSize; over > 0 {
+		for _, m := range p.messages[:over] {
+			s.dropped(m, true)
+		}
+		p.messages = p.messages[over:]
+	}
+}
+
+// carry 把還沒寫出的訊息移到 parking，排在斷線後收到的訊息之前，恢復後補送
+// (move the messages not written yet to the parking buffer, ahead of the later ones, to replay them on resume)
+func (p *parking) carry(s *Session) {
+	var pending []*box
+
+	s.queueMutex.Lock()
+drain:
+	for {
+		select {
+		case m := <-s.output:
+			if !isControl(m) {
+				pending = append(pending, m)
+			}
+		default:
+			break drain
+		}
+	}
+	s.queueMutex.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	p.mutex.Lock()
+	if p.next == nil && !p.expired {
+		later := p.messages
+		p.messages = pending
+		p.buffer(s, later...)
+	}
+	p.mutex.Unlock()
+}
+
+// ResumeToken returns the token a client presents, through Option.ResumeQueryParam or
+// Option.ResumeHeader, to resume this session after a disconnection.
+// The token is also sent in the ResumeHeader of the upgrade response.
+func (s *Session) ResumeToken() string {
+	return s.resumeToken
+}
+
+// Resumed reports whether the session resumed a disconnected one.
+func (s *Session) Resumed() bool {
+	return s.resumed
+}
+
+func (s *Session) parking() *parking {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	return s.parked
+}
+
+// resumable 判斷斷線的Session是否保留等待恢復 (whether a disconnected session is kept for resumption)
+func (h *Hail) resumable(info DisconnectInfo) bool {
+	if h.Option.ResumeGrace <= 0 || h.hub.closed() {
+		return false
+	}
+
+	switch info.Cause {
+	case DisconnectNetwork, DisconnectPongTimeout, DisconnectWriteError:
+		return true
+	case DisconnectClient:
+		return info.Code != CloseNormalClosure
+	}
+
+	return false
+}
+
+// park 保留Session的訂閱並暫存訊息，直到恢復或超過 ResumeGrace
+// (keep the subscriptions of s and buffer its messages until it is resumed or ResumeGrace elapses)
+func (h *Hail) park(s *Session) {
+	p := &parking{deadline: h.Option.Clock.Now().Add(h.Option.ResumeGrace)}
+
+	s.rwMutex.Lock()
+	s.parked = p
+	s.rwMutex.Unlock()
+
+	s.logger.Debug("session parked", "grace", h.Option.ResumeGrace)
+
+	h.resumeMutex.Lock()
+	h.parkedSessions[s.resumeToken] = s
+	p.timer = h.Option.Clock.AfterFunc(h.Option.ResumeGrace, func() {
+		h.expire(s)
+	})
+	h.resumeMutex.Unlock()
+}
+
+// expire 放棄等待恢復，取消所有訂閱 (give up waiting for s to be resumed and drop its subscriptions)
+func (h *Hail) expire(s *Session) {
+	h.resumeMutex.Lock()
+	if h.parkedSessions[s.resumeToken] != s {
+		h.resumeMutex.Unlock()
+		return
+	}
+	delete(h.parkedSessions, s.resumeToken)
+	h.resumeMutex.Unlock()
+
+	h.abandon(s)
+}
+
+// repark 恢復失敗時把Session放回等待，期限不變 (put s back to wait for resumption after a failed resume, keeping its deadline)
+func (h *Hail) repark(s *Session) {
+	remaining := s.parking().deadline.Sub(h.Option.Clock.Now())
+
+	h.resumeMutex.Lock()
+	// 關機時 dropParked 已經清過，不再放回 (once shutting down dropParked already ran, do not put it back)
+	if remaining > 0 && !h.hub.closed() {
+		h.parkedSessions[s.resumeToken] = s
+		s.parking().timer = h.Option.Clock.AfterFunc(remaining, func() {
+			h.expire(s)
+		})
+		h.resumeMutex.Unlock()
+		s.logger.Debug("resume failed, session parked again", "grace", remaining)
+		return
+	}
+	h.resumeMutex.Unlock()
+
+	h.abandon(s)
+}
+
+// abandon 放棄已不在等待中的Session，取消所有訂閱 (give up a session no longer waiting and drop its subscriptions)
+func (h *Hail) abandon(s *Session) {
+	p := s.parking()
+	p.mutex.Lock()
+	p.expired = true
+	p.messages = nil
+	p.mutex.Unlock()
+
+	s.logger.Debug("parked session expired")
+	h.pubSub.Unsub(s)
+}
+
+// takeParked 取出 token 對應、仍在等待恢復的Session (take the parked session identified by token)
+func (h *Hail) takeParked(r *http.Request, userID string) *Session {
+	token := r.URL.Query().Get(h.Option.ResumeQueryParam)
+	if token == "" {
+		token = r.Header.Get(h.Option.ResumeHeader)
+	}
+
+	if token == "" {
+		return nil
+	}
+
+	h.resumeMutex.Lock()
+	defer h.resumeMutex.Unlock()
+
+	s, ok := h.parkedSessions[token]
+	if !ok {
+		return nil
+	}
+
+	// 只能恢復同一個使用者的Session，未驗證的連線不能恢復已綁定使用者的Session
+	// (only a session of the same user is resumed, an anonymous connection cannot resume a bound session)
+	if s.UserID() != userID {
+		return nil
+	}
+
+	delete(h.parkedSessions, token)
+	s.parking().timer.Stop()
+
+	return s
+}
+
+// restore 將舊Session的狀態帶到新的Session，在升級前呼叫 (carry the state of old over to s, called before the upgrade)
+func (s *Session) restore(old *Session) {
+	s.hashID = old.hashID
+	s.userID = old.UserID()
+	s.resumed = true
+
+	old.keyMutex.RLock()
+	keys := make(map[string]interface{}, len(old.Keys)+len(s.Keys))
+	for k, v := range old.Keys {
+		keys[k] = v
+	}
+	old.keyMutex.RUnlock()
+
+	for k, v := range s.Keys {
+		keys[k] = v
+	}
+	s.Keys = keys
+}
+
+// resume 補送斷線期間的訊息，並把訂閱移交給新的Session (replay the buffered messages and hand the subscriptions over to s)
+func (h *Hail) resume(old, s *Session) {
+	p := old.parking()
+
+	p.mutex.Lock()
+	for _, message := range p.messages {
+		s.queue(message, 0)
+	}
+	p.messages = nil
+	p.next = s
+	p.mutex.Unlock()
+
+	h.pubSub.Transfer(old, s)
+}
+
+// dropParked 放棄所有等待恢復的Session (give up every parked session)
+func (h *Hail) dropParked() {
+	h.resumeMutex.Lock()
+	sessions := make([]*Session, 0, len(h.parkedSessions))
+	for _, s := range h.parkedSessions {
+		s.parking().timer.Stop()
+		sessions = append(sessions, s)
+	}
+	h.resumeMutex.Unlock()
+
+	for _, s := range sessions {
+		h.expire(s)
+	}
+}
@@ -0,0 +1,81 @@
+package hail_test
+
+import (
+	"github.com/lishank0119/hail"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResumeCarriesUnwrittenOutput(t *testing.T) {
+	srv := newServer(t, &hail.Option{ResumeGrace: time.Minute})
+	h := srv.Hail
+	ids := connectID(h)
+	stalled, release := stall(t, h)
+
+	parked := make(chan struct{}, 1)
+	h.HandleDisconnectInfo(func(s *hail.Session, info hail.DisconnectInfo) {
+		if info.Parked {
+			parked <- struct{}{}
+		}
+	})
+
+	c := srv.Dial(t)
+	id := <-ids
+	token := c.Response.Header.Get("X-Hail-Resume-Token")
+	subscribe(c, "room")
+
+	h.SendTo(id, []byte("stall"))
+	<-stalled
+	h.SendTo(id, []byte("1"))
+	h.SendTo(id, []byte("2"))
+
+	c.Drop()
+	<-parked
+	release()
+	h.PubTextMsg([]byte("3"), false, "room")
+
+	resumed := srv.DialWith(t, "resume_token="+token, nil)
+	<-ids
+	for _, m := range []string{"1", "2", "3"} {
+		resumed.Expect(m)
+	}
+}
+
+func TestResumeSurvivesFailedUpgrade(t *testing.T) {
+	srv := newServer(t, &hail.Option{
+		ResumeGrace: time.Minute,
+		CheckOrigin: func(r *http.Request) bool {
+			return r.Header.Get("X-Fail") == ""
+		},
+	})
+	h := srv.Hail
+	ids := connectID(h)
+
+	parked := make(chan struct{}, 1)
+	h.HandleDisconnectInfo(func(s *hail.Session, info hail.DisconnectInfo) {
+		if info.Parked {
+			parked <- struct{}{}
+		}
+	})
+
+	c := srv.Dial(t)
+	id := <-ids
+	token := c.Response.Header.Get("X-Hail-Resume-Token")
+	subscribe(c, "room")
+	c.Drop()
+	<-parked
+
+	if failed, _ := srv.TryDial(t, "resume_token="+token, http.Header{"X-Fail": {"1"}}); failed != nil {
+		t.Fatal("upgrade with a rejected origin succeeded")
+	}
+
+	h.PubTextMsg([]byte("missed"), false, "room")
+
+	resumed := srv.DialWith(t, "resume_token="+token, nil)
+	if got := <-ids; got != id {
+		t.Fatalf("resumed as %s, want %s", got, id)
+	}
+	resumed.Expect("missed")
+	resumed.ExpectNothing(50 * time.Millisecond)
+}
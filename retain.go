@@ -0,0 +1,80 @@
+package hail
+
+import "time"
+
+// TopicOptions configures a topic with Hail.ConfigureTopic.
+type TopicOptions struct {
+	// Retain 保留最後幾則訊息，新的訂閱者會先收到它們 (how many of the last messages are kept and replayed to new subscribers)
+	// 1 keeps only the last value, 0 does not limit the count when RetainFor is set.
+	Retain int
+	// RetainFor 保留訊息的時間，0 代表不限 (how long a retained message is kept, 0 means forever)
+	// Set alone, it keeps every message of the last RetainFor. Retention is off when both are 0.
+	RetainFor time.Duration
+	// Presence 成員加入與離開時發布 TopicPresenceEvent 到此topic (publish a TopicPresenceEvent to the topic when a member joins or leaves)
+	Presence bool
+}
+
+type retainedMessage struct {
+	msg *box
+	at  time.Time
+}
+
+// retention 一個 topic 保留的訊息 (the messages retained for one topic)
+type retention struct {
+	options  TopicOptions
+	messages []retainedMessage
+}
+
+func (r *retention) add(msg *box, now time.Time) {
+	r.messages = append(r.messages, retainedMessage{msg: msg, at: now})
+	r.expire(now)
+}
+
+// expire 移除超過 Retain 數量或 RetainFor 時間的訊息 (drop the messages beyond Retain or older than RetainFor)
+func (r *retention) expire(now time.Time) {
+	if r.options.Retain > 0 && len(r.messages) > r.options.Retain {
+		r.messages = r.messages[len(r.messages)-r.options.Retain:]
+	}
+
+	if r.options.RetainFor <= 0 {
+		return
+	}
+
+	i := 0
+	for i < len(r.messages) && now.Sub(r.messages[i].at) > r.options.RetainFor {
+		i++
+	}
+	r.messages = r.messages[i:]
+}
+
+// replay 回傳要送給新訂閱者的保留訊息 (return the retained messages to send to a new subscriber)
+func (r *retention) replay(now time.Time) []*box {
+	r.expire(now)
+
+	messages := make([]*box, 0, len(r.messages))
+	for _, m := range r.messages {
+		messages = append(messages, m.msg)
+	}
+
+	return messages
+}
+
+// matchTopic 判斷 topic 是否符合訂閱的 filter (whether topic matches the subscription filter)
+func matchTopic(filter, topic string) bool {
+	filterLevels, topicLevels := splitTopic(filter), splitTopic(topic)
+	for i, level := range filterLevels {
+		if level == multiLevelWildcard {
+			return true
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		if level != singleLevelWildcard && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
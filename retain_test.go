@@ -0,0 +1,78 @@
+package hail_test
+
+import (
+	"context"
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/hailtest"
+	"testing"
+	"time"
+)
+
+func TestRetainForFollowsClock(t *testing.T) {
+	clock := hailtest.NewClock()
+	srv := newServer(t, &hail.Option{Clock: clock})
+	h := srv.Hail
+
+	h.ConfigureTopic("prices", hail.TopicOptions{Retain: 5, RetainFor: time.Minute})
+	h.PubTextMsg([]byte("old"), false, "prices")
+	clock.Advance(2 * time.Minute)
+	h.PubTextMsg([]byte("new"), false, "prices")
+
+	c := srv.Dial(t)
+	c.Send("sub:prices")
+	expectSet(t, c, "new", "subscribed")
+	c.ExpectNothing(50 * time.Millisecond)
+}
+
+func TestRetainForAlone(t *testing.T) {
+	clock := hailtest.NewClock()
+	srv := newServer(t, &hail.Option{Clock: clock})
+	h := srv.Hail
+
+	h.ConfigureTopic("prices", hail.TopicOptions{RetainFor: time.Minute})
+	h.PubTextMsg([]byte("old"), false, "prices")
+	clock.Advance(2 * time.Minute)
+	h.PubTextMsg([]byte("a"), false, "prices")
+	h.PubTextMsg([]byte("b"), false, "prices")
+
+	c := srv.Dial(t)
+	c.Send("sub:prices")
+	expectSet(t, c, "a", "b", "subscribed")
+	c.ExpectNothing(50 * time.Millisecond)
+}
+
+func TestReplayCallbacksCanCallPubSub(t *testing.T) {
+	srv := newServer(t, &hail.Option{ChannelBufferSize: 1})
+	h := srv.Hail
+
+	counted := make(chan int, 1)
+	h.HandleError(func(s *hail.Session, err error) {
+		select {
+		case counted <- h.TopicCount("prices"):
+		default:
+		}
+	})
+
+	h.ConfigureTopic("prices", hail.TopicOptions{Retain: 200})
+	for i := 0; i < 20; i++ {
+		h.PubTextMsg([]byte("price"), false, "prices")
+	}
+
+	c := srv.Dial(t)
+	c.Send("sub:prices")
+
+	select {
+	case n := <-counted:
+		if n != 1 {
+			t.Fatalf("TopicCount returned %d from the error handler, want 1", n)
+		}
+	case <-time.After(hailtest.DefaultTimeout):
+		t.Fatal("the error handler did not return, the pubsub loop is blocked")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hailtest.DefaultTimeout)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
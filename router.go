@@ -0,0 +1,220 @@
+package hail
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/lesismal/nbio/nbhttp/websocket"
+	"sync"
+)
+
+// Envelope is the JSON frame of the event protocol, such as {"event":"chat.send","id":7,"data":{...}}.
+// Replies set Reply and carry the id of the message they answer, and Error is set when its handler failed.
+type Envelope struct {
+	Event string          `json:"event,omitempty"`
+	ID    json.RawMessage `json:"id,omitempty"`
+	Reply bool            `json:"reply,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty"`
+	Trace *SpanContext    `json:"trace,omitempty"` // optional trace context, replies carry the span of the handler
+}
+
+// ClientError is an error of an event handler meant for the client: its Message is sent back in
+// the Error of the reply. Other errors go to HandleError and the client only sees "internal error".
+type ClientError struct {
+	Message string
+}
+
+func (e *ClientError) Error() string {
+	return e.Message
+}
+
+// internalError 不是給客戶端的錯誤，回覆時以此取代 (replaces, in replies, the errors not meant for the client)
+const internalError = "internal error"
+
+type handleUnknownEventFunc func(*Session, string, json.RawMessage) error
+
+// eventHandler 事件的處理函式，request 表示以 OnRequest 註冊，一定回覆 (the handler of an event, request is set by OnRequest, which always replies)
+type eventHandler struct {
+	fn      handleRequestFunc
+	request bool
+}
+
+// router 依事件名稱分派文字訊息，沒有註冊任何事件時不啟用
+// (dispatches text messages by event name, disabled until an event is registered)
+type router struct {
+	rwMutex  sync.RWMutex
+	enabled  bool
+	handlers map[string]eventHandler
+	unknown  handleUnknownEventFunc
+}
+
+func newRouter() *router {
+	return &router{
+		handlers: make(map[string]eventHandler),
+		unknown: func(*Session, string, json.RawMessage) error {
+			return ErrUnknownEvent
+		},
+	}
+}
+
+// On routes the text messages whose envelope event is event to fn, with the raw data of the
+// envelope. When fn returns an error it is sent back as {"event":event,"id":id,"reply":true,"error":"..."},
+// see ClientError, and with Option.AckEvents envelopes carrying an id are acknowledged with
+// {"event":event,"id":id,"reply":true}. Once an event is registered, text messages that are not
+// envelopes still go to HandleMessage.
+func (h *Hail) On(event string, fn func(*Session, json.RawMessage) error) {
+	h.router.add(event, func(s *Session, data json.RawMessage) (interface{}, error) {
+		return nil, fn(s, data)
+	}, false)
+}
+
+func (r *router) add(event string, fn handleRequestFunc, request bool) {
+	r.rwMutex.Lock()
+	defer r.rwMutex.Unlock()
+
+	r.enabled = true
+	r.handlers[event] = eventHandler{fn: fn, request: request}
+}
+
+// OnUnknown fires fn for envelopes whose event has no handler. By default ErrUnknownEvent is
+// sent back to the client.
+func (h *Hail) OnUnknown(fn func(s *Session, event string, data json.RawMessage) error) {
+	h.router.rwMutex.Lock()
+	defer h.router.rwMutex.Unlock()
+
+	h.router.enabled = true
+	h.router.unknown = fn
+}
+
+func (r *router) enable() {
+	r.rwMutex.Lock()
+	defer r.rwMutex.Unlock()
+
+	r.enabled = true
+}
+
+// route 分派訊息，不是事件訊息時回傳false (dispatch the message, returns false when it is not an envelope)
+func (h *Hail) route(s *Session, msg []byte) bool {
+	h.router.rwMutex.RLock()
+	enabled := h.router.enabled
+	h.router.rwMutex.RUnlock()
+
+	if !enabled {
+		return false
+	}
+
+	var envelope Envelope
+	if json.Unmarshal(msg, &envelope) != nil {
+		return false
+	}
+
+	// 客戶端對 Session.Call 的回覆 (a client reply to Session.Call)
+	if envelope.Reply {
+		return s.requests.resolve(&envelope)
+	}
+
+	if envelope.Event == "" {
+		return false
+	}
+
+	h.router.rwMutex.RLock()
+	handler, ok := h.router.handlers[envelope.Event]
+	unknown := h.router.unknown
+	h.router.rwMutex.RUnlock()
+
+	span := h.startEvent(s, &envelope)
+	defer span.End()
+
+	var result interface{}
+	var err error
+	if ok {
+		result, err = handler.fn(s, envelope.Data)
+	} else {
+		err = unknown(s, envelope.Event, envelope.Data)
+	}
+
+	answer := &Envelope{Event: envelope.Event, ID: envelope.ID, Reply: envelope.ID != nil}
+	if envelope.Trace != nil {
+		sc := span.Context()
+		answer.Trace = &sc
+	}
+
+	switch {
+	case err != nil:
+		span.SetAttribute(AttrError, err.Error())
+		answer.Error = h.clientError(s, err)
+	case envelope.ID == nil:
+		return true
+	case !handler.request && !h.Option.AckEvents:
+		return true
+	case result != nil:
+		if answer.Data, err = json.Marshal(result); err != nil {
+			answer.Error = h.clientError(s, err)
+		}
+	}
+
+	s.reply(answer)
+
+	return true
+}
+
+// clientError 回傳要送給客戶端的錯誤訊息，其他錯誤交給 HandleError
+// (return the error text sent to the client, other errors go to HandleError)
+func (h *Hail) clientError(s *Session, err error) string {
+	var clientErr *ClientError
+	if errors.As(err, &clientErr) {
+		return clientErr.Message
+	}
+
+	if errors.Is(err, ErrUnknownEvent) {
+		return ErrUnknownEvent.Error()
+	}
+
+	s.logger.Warn("event handler failed", "error", err)
+	h.errorHandler(s, err)
+
+	return internalError
+}
+
+// startEvent 分派事件時開始 span，父 span 是 envelope 的 trace，沒有時是 hail.receive
+// (start the span of a routed event, its parent is the trace of the envelope or else hail.receive)
+func (h *Hail) startEvent(s *Session, envelope *Envelope) Span {
+	parent := s.receivedSpan()
+	if envelope.Trace != nil {
+		parent = *envelope.Trace
+	}
+
+	if !h.traced() {
+		return nopSpan{parent}
+	}
+
+	return h.Option.Tracer.Start(parent, "hail.event", map[string]interface{}{
+		AttrSessionID:   s.hashID,
+		AttrEvent:       envelope.Event,
+		AttrMessageSize: len(envelope.Data),
+	})
+}
+
+// Emit sends v, encoded as JSON, to the session as the data of an envelope named event.
+func (s *Session) Emit(event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.reply(&Envelope{Event: event, Data: data})
+}
+
+// reply 送出一個事件訊息 (send an envelope to the session)
+func (s *Session) reply(envelope *Envelope) error {
+	msg, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	if s.closed() {
+		return ErrWriteCloseSession
+	}
+
+	return s.writeMessage(&box{t: websocket.TextMessage, msg: msg})
+}
@@ -0,0 +1,57 @@
+package hail_test
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/lishank0119/hail"
+	"testing"
+	"time"
+)
+
+func TestEventErrorsStayOnServer(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+	h := srv.Hail
+
+	handled := make(chan error, 1)
+	h.HandleError(func(s *hail.Session, err error) {
+		handled <- err
+	})
+	h.On("db", func(s *hail.Session, data json.RawMessage) error {
+		return errors.New("dial tcp 10.0.0.5:5432: connection refused")
+	})
+	h.On("name", func(s *hail.Session, data json.RawMessage) error {
+		return &hail.ClientError{Message: "name is taken"}
+	})
+
+	c := srv.Dial(t)
+
+	c.Send(`{"event":"db","id":1}`)
+	c.Expect(`{"event":"db","id":1,"reply":true,"error":"internal error"}`)
+	if err := <-handled; err.Error() != "dial tcp 10.0.0.5:5432: connection refused" {
+		t.Fatalf("HandleError got %v", err)
+	}
+
+	c.Send(`{"event":"name","id":2}`)
+	c.Expect(`{"event":"name","id":2,"reply":true,"error":"name is taken"}`)
+
+	c.Send(`{"event":"nope","id":3}`)
+	c.Expect(`{"event":"nope","id":3,"reply":true,"error":"unknown event"}`)
+}
+
+func TestAckEventsIsOptIn(t *testing.T) {
+	for _, ack := range []bool{false, true} {
+		srv := newServer(t, &hail.Option{AckEvents: ack})
+		srv.Hail.On("ping", func(s *hail.Session, data json.RawMessage) error {
+			return nil
+		})
+
+		c := srv.Dial(t)
+		c.Send(`{"event":"ping","id":1}`)
+
+		if ack {
+			c.Expect(`{"event":"ping","id":1,"reply":true}`)
+		} else {
+			c.ExpectNothing(50 * time.Millisecond)
+		}
+	}
+}
@@ -2,8 +2,8 @@ package hail
 
 import (
 	bytes2 "bytes"
-	"errors"
 	"github.com/lesismal/nbio/nbhttp/websocket"
+	"log/slog"
 	"net"
 	"net/http"
 	"sync"
@@ -17,11 +17,36 @@ type Session struct {
 	conn       *websocket.Conn
 	output     chan *box
 	outputDone chan struct{}
+	queueMutex *sync.Mutex   // 放入 output 時持有，讓丟棄舊訊息時可以重排 (held to put on output, so evicting can reorder it)
+	space      chan struct{} // output 被取出時通知 BlockWithTimeout 的等待者 (wakes BlockWithTimeout waiters when output is read)
+	backlog    *backlog
 	hail       *Hail
 	open       bool
 	hashID     string
+	userID     string // 由 hub.userMutex 保護 (guarded by hub.userMutex)
 	rwMutex    *sync.RWMutex
-	subChan    chan *box
+
+	connectedAt   time.Time
+	disconnect    DisconnectInfo // 由 rwMutex 保護 (guarded by rwMutex)
+	disconnectSet bool
+
+	resumeToken string
+	resumed     bool
+	parked      *parking // 由 rwMutex 保護 (guarded by rwMutex)
+
+	requests *requests
+	identity Identity
+	limiter  *rateLimiter // 由 rwMutex 保護 (guarded by rwMutex)
+	delayed  *delayed
+	ticket   *ticket
+	logger   *slog.Logger
+	lastSeen time.Time     // 由 rwMutex 保護 (guarded by rwMutex)
+	received SpanContext   // 正在處理的訊息的 hail.receive span，由 rwMutex 保護 (the hail.receive span of the message being handled, guarded by rwMutex)
+	ticker   Ticker        // ping 的 ticker，在升級前建立 (the ping ticker, created before the upgrade)
+	sent     *box          // outbound middleware 寫出的訊息，只由 run 使用 (the message written by the outbound chain, only used by run)
+	sendErr  error         // 只由 run 使用 (only used by run)
+	inbox    chan inbound  // 等待 handle 處理的訊息 (messages waiting for handle)
+	handled  chan struct{} // handle 結束時關閉 (closed once handle returns)
 }
 
 func (s *Session) start(w http.ResponseWriter, r *http.Request) error {
@@ -29,38 +54,74 @@ func (s *Session) start(w http.ResponseWriter, r *http.Request) error {
 
 	u.SetPongHandler(func(c *websocket.Conn, text string) {
 		c.SetReadDeadline(time.Now().Add(s.hail.Option.PongWait))
+		s.seen()
+		if rtt, ok := pingRTT(text); ok {
+			s.hail.observers.pingRTT(s, rtt)
+		}
 		s.hail.pongHandler(s)
 	})
 
-	if s.hail.closeHandler != nil {
-		u.SetCloseHandler(func(conn *websocket.Conn, i int, msg string) {
+	u.SetCloseHandler(func(conn *websocket.Conn, i int, msg string) {
+		// 伺服器已送出 close frame 時，這是對方的回應，不需再回送 (when the server started the close, this is the echo)
+		echo := !s.disconnectRecorded()
+		s.setDisconnect(DisconnectClient, &box{t: websocket.CloseMessage, msg: closeMessage(i, msg)}, nil)
+
+		if s.hail.closeHandler != nil {
 			s.hail.closeHandler(s, i, msg)
-		})
-	}
+		}
+
+		if echo {
+			if i == CloseNoStatusReceived {
+				conn.WriteMessage(websocket.CloseMessage, nil)
+			} else {
+				conn.WriteClose(i, msg)
+			}
+		}
+	})
 
 	u.OnOpen(func(conn *websocket.Conn) {
 		s.hail.connectHandler(s)
 	})
 
 	u.OnClose(func(conn *websocket.Conn, err error) {
-		if !s.hail.hub.closed() {
-			s.hail.hub.unregister <- s
+		select {
+		case s.hail.hub.unregister <- s:
+			s.hail.sessionLeft(s)
+		case <-s.hail.hub.done:
+			if s.hail.hub.remove(s) {
+				s.hail.sessionLeft(s)
+			}
+		}
+
+		info := s.disconnectInfo(err)
+		if s.hail.resumable(info) {
+			info.Parked = true
+			s.hail.park(s)
 		}
 
+		s.logger.Debug("session disconnected", "cause", info.Cause.String(), "code", info.Code, "reason", info.Reason,
+			"error", info.Err, "duration", info.Duration, "parked", info.Parked)
+
 		s.Close()
+		// 處理函式都結束後才回報斷線 (the disconnect is reported once the handlers are done)
+		<-s.handled
+		s.hail.release(s.ticket)
 		s.hail.disconnectHandler(s)
+		s.hail.observers.sessionDisconnected(s, info)
+		s.hail.disconnectInfoHandler(s, info)
 	})
 
 	u.OnMessage(func(c *websocket.Conn, messageType websocket.MessageType, bytes []byte) {
 		c.SetReadDeadline(time.Now().Add(s.hail.Option.PongWait))
+		s.seen()
 
-		if messageType == websocket.TextMessage {
-
-			s.hail.messageHandler(s, bytes2.Clone(bytes))
-		}
-
-		if messageType == websocket.BinaryMessage {
-			s.hail.messageHandlerBinary(s, bytes2.Clone(bytes))
+		if messageType == websocket.TextMessage || messageType == websocket.BinaryMessage {
+			s.hail.observers.messageReceived(s, messageType, len(bytes))
+			// Call 的回覆不排在處理函式之後，處理函式可以等待它 (a reply to Call does not wait behind the handlers, so a handler may wait for it)
+			if messageType == websocket.TextMessage && s.resolveReply(bytes) {
+				return
+			}
+			s.admit(messageType, bytes2.Clone(bytes))
 		}
 	})
 
@@ -70,26 +131,105 @@ func (s *Session) start(w http.ResponseWriter, r *http.Request) error {
 
 	conn, err := u.Upgrade(w, r, w.Header())
 	if err != nil {
+		close(s.handled)
 		return err
 	}
 
 	s.conn = conn
 
+	s.hail.sessionWG.Add(1)
+	go func() {
+		defer s.hail.sessionWG.Done()
+		s.handle()
+	}()
+
 	return nil
 }
 
+// inbound 一則等待處理的訊息 (a message waiting to be handled)
+type inbound struct {
+	t   MessageType
+	msg []byte
+}
+
+// inboxSize 讀取迴圈可以先讀入的訊息數，處理函式忙碌時的上限 (how many messages the read loop reads ahead of a busy handler)
+const inboxSize = 64
+
+// handOff 交給 handle 處理，Session關閉後丟棄 (hand a message over to handle, dropped once the session is closed)
+func (s *Session) handOff(t MessageType, msg []byte) {
+	select {
+	case s.inbox <- inbound{t: t, msg: msg}:
+	case <-s.outputDone:
+	}
+}
+
+// handle 依序處理收到的訊息，關閉時處理完已讀入的訊息 (handle the inbound messages in order, finishing the ones already read on close)
+func (s *Session) handle() {
+	defer close(s.handled)
+
+	for {
+		select {
+		case m := <-s.inbox:
+			s.receive(m.t, m.msg)
+		case <-s.outputDone:
+			for {
+				select {
+				case m := <-s.inbox:
+					s.receive(m.t, m.msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
 func (s *Session) Close() {
-	s.rwMutex.RLock()
-	defer s.rwMutex.RUnlock()
+	s.rwMutex.Lock()
+	if !s.open {
+		s.rwMutex.Unlock()
+		return
+	}
+	s.open = false
+	s.rwMutex.Unlock()
+
+	s.conn.Close()
+	close(s.outputDone)
 
-	if s.open {
-		s.open = false
-		s.conn.Close()
-		close(s.outputDone)
-		s.hail.pubSub.Unsub(s.subChan)
+	// 等待恢復的Session保留訂閱與還沒寫出的訊息 (a parked session keeps its subscriptions and the messages not written yet)
+	if p := s.parking(); p != nil {
+		p.carry(s)
+	} else {
+		s.hail.pubSub.Unsub(s)
 	}
 }
 
+// closeWithMessage 送出最後一則訊息，並在 CloseSessionWaitTime 後關閉 (send a last message and close after CloseSessionWaitTime)
+func (s *Session) closeWithMessage(message *box) {
+	s.setDisconnect(DisconnectServer, message, nil)
+	s.writeMessage(message)
+	time.AfterFunc(s.hail.Option.CloseSessionWaitTime, func() {
+		s.Close()
+	})
+}
+
+// CloseWithReason sends a close frame with code and reason to the session, then waits for the
+// peer to answer it, or for CloseSessionWaitTime, before closing the connection.
+func (s *Session) CloseWithReason(code int, reason string) error {
+	if s.closed() {
+		return ErrWriteCloseSession
+	}
+
+	message, err := newCloseBox(code, reason)
+	if err != nil {
+		return err
+	}
+
+	s.closeWithMessage(message)
+
+	return nil
+}
+
 func (s *Session) closed() bool {
 	s.rwMutex.RLock()
 	defer s.rwMutex.RUnlock()
@@ -112,23 +252,30 @@ func (s *Session) RemoteAddr() net.Addr {
 	return s.conn.RemoteAddr()
 }
 
-func (s *Session) writeMessage(message *box) {
+func (s *Session) writeMessage(message *box) error {
+	return s.queue(message, s.hail.Option.SlowConsumerTimeout)
+}
+
+// queue 將訊息放入 output，BlockWithTimeout 最多等待 wait (queue message on output, BlockWithTimeout waits at most wait)
+func (s *Session) queue(message *box, wait time.Duration) (err error) {
 	defer func() {
-		if recover() != nil {
-			s.hail.errorHandler(s, ErrWriteCloseSessionForRecover)
+		if r := recover(); r != nil {
+			err = ErrWriteCloseSessionForRecover
+			s.logger.Error("recovered panic writing to session", "panic", r)
+			s.hail.errorHandler(s, err)
 		}
 	}()
 
 	if s.closed() {
+		if p := s.parking(); p != nil {
+			return p.write(s, message)
+		}
+
 		s.hail.errorHandler(s, ErrWriteCloseSession)
-		return
+		return ErrWriteCloseSession
 	}
 
-	select {
-	case s.output <- message:
-	default:
-		s.hail.errorHandler(s, ErrSessionMessageBufferIsFull)
-	}
+	return s.enqueue(message, wait)
 }
 
 func (s *Session) writeRaw(message *box) error {
@@ -147,7 +294,9 @@ func (s *Session) writeRaw(message *box) error {
 }
 
 func (s *Session) ping() {
-	s.writeRaw(&box{t: websocket.PingMessage, msg: []byte{}})
+	if err := s.writeRaw(&box{t: websocket.PingMessage, msg: pingPayload()}); err != nil {
+		s.logger.Warn("ping failed", "error", err)
+	}
 }
 
 func (s *Session) Write(msg []byte) error {
@@ -155,9 +304,7 @@ func (s *Session) Write(msg []byte) error {
 		return ErrWriteCloseSession
 	}
 
-	s.writeMessage(&box{t: websocket.TextMessage, msg: msg})
-
-	return nil
+	return s.writeMessage(&box{t: websocket.TextMessage, msg: msg})
 }
 
 // WriteBinary writes a binary message to session.
@@ -166,8 +313,7 @@ func (s *Session) WriteBinary(msg []byte) error {
 		return ErrWriteCloseSession
 	}
 
-	s.writeMessage(&box{t: websocket.BinaryMessage, msg: msg})
-	return nil
+	return s.writeMessage(&box{t: websocket.BinaryMessage, msg: msg})
 }
 
 // Set is used to store a new key/value pair exclusively for this session.
@@ -218,37 +364,54 @@ func (s *Session) GetHashID() string {
 	return s.hashID
 }
 
+// BindUser associates the session with userID, so that it can be reached with
+// Hail.SendToUser and Hail.CloseUser. An empty userID unbinds the session.
+// It may be called from HandleConnect, handlers and Broadcast filters. HandlePresence fires
+// again, with the user, the first time a connected session is bound.
+func (s *Session) BindUser(userID string) {
+	if registered, previous := s.hail.hub.bindUser(s, userID); registered && previous != userID {
+		s.hail.userBound(s, previous)
+	}
+}
+
+// UserID returns the user the session is bound to, or "" when unbound.
+func (s *Session) UserID() string {
+	s.hail.hub.userMutex.RLock()
+	defer s.hail.hub.userMutex.RUnlock()
+
+	return s.userID
+}
+
 // AddSub 訂閱某個,多個topic (Session subscribe one or multi topics)
+// Topics are split into levels by "/". A "+" level matches exactly one level and a trailing
+// "#" level matches any number of levels, such as "market/+/trades" or "orders/#".
 func (s *Session) AddSub(topicNames ...string) {
-	if s.subChan != nil {
-		s.hail.pubSub.AddSub(s.subChan, topicNames...)
-	} else {
-		var str = ""
-		for _, topicName := range topicNames {
-			str += topicName + ","
+	if s.closed() {
+		s.hail.errorHandler(s, ErrWriteCloseSession)
+		return
+	}
+
+	valid := make([]string, 0, len(topicNames))
+	for _, topicName := range topicNames {
+		if !validTopicFilter(topicName) {
+			s.hail.errorHandler(s, ErrInvalidTopic)
+			continue
 		}
-		str = str[0 : len(str)-1]
-		s.hail.errorHandler(s, errors.New("error of add current channel,"+str))
+		valid = append(valid, topicName)
+	}
+
+	if len(valid) > 0 {
+		s.hail.pubSub.AddSub(s, valid...)
 	}
 }
 
 // UnSub (Session unsubscribe one or multi topics, if no topics ,will unsubscribe all topics)
 func (s *Session) UnSub(topicNames ...string) {
-	if s.subChan != nil {
-		s.hail.pubSub.Unsub(s.subChan, topicNames...)
-	} else {
-		var str = ""
-		for _, topicName := range topicNames {
-			str += topicName + ","
-		}
-		str = str[0 : len(str)-1]
-		s.hail.errorHandler(s, errors.New("error of unsub current channel,"+str))
-	}
+	s.hail.pubSub.Unsub(s, topicNames...)
 }
 
 func (s *Session) run() {
-	ticker := time.NewTicker(s.hail.Option.PingPeriod)
-	defer ticker.Stop()
+	defer s.ticker.Stop()
 
 loop:
 	for {
@@ -258,10 +421,21 @@ loop:
 				break loop
 			}
 
-			err := s.writeRaw(msg)
+			select {
+			case s.space <- struct{}{}:
+			default:
+			}
+
+			start := time.Now()
+			span := s.startWrite(msg, start)
+			sent, err := s.send(msg)
+			span.End()
 
 			if err != nil {
+				s.logger.Warn("write failed", "error", err)
 				s.hail.errorHandler(s, err)
+				s.setDisconnect(DisconnectWriteError, nil, err)
+				s.conn.Close()
 				break loop
 			}
 
@@ -269,35 +443,28 @@ loop:
 				break loop
 			}
 
-			if msg.t == websocket.TextMessage {
-				s.hail.messageSentHandler(s, msg.msg)
+			// 被 outbound middleware 丟棄 (dropped by an outbound middleware)
+			if sent == nil {
+				continue
 			}
 
-			if msg.t == websocket.BinaryMessage {
-				s.hail.messageSentHandlerBinary(s, msg.msg)
-			}
-		case msg, ok := <-s.subChan:
-			if !ok {
-				break loop
-			}
-			err := s.writeRaw(msg)
-			if err != nil {
-				s.hail.errorHandler(s, err)
-				break loop
-			}
+			s.hail.observers.messageSent(s, sent.t, len(sent.msg), time.Since(start), len(s.output))
 
-			if msg.t == websocket.CloseMessage {
-				break loop
+			if sent.t == websocket.TextMessage {
+				s.hail.messageSentHandler(s, sent.msg)
 			}
 
-			if msg.t == websocket.TextMessage {
-				s.hail.messageSentHandler(s, msg.msg)
+			if sent.t == websocket.BinaryMessage {
+				s.hail.messageSentHandlerBinary(s, sent.msg)
 			}
-
-			if msg.t == websocket.BinaryMessage {
-				s.hail.messageSentHandlerBinary(s, msg.msg)
+		case <-s.ticker.C():
+			// 讀取逾時之外，也依 Clock 檢查 pong，讓測試可以控制時間 (besides the read deadline, check the pong with Clock so tests control the time)
+			if s.pongExpired() {
+				s.logger.Debug("pong timeout")
+				s.setDisconnect(DisconnectPongTimeout, nil, nil)
+				s.conn.Close()
+				break loop
 			}
-		case <-ticker.C:
 			s.ping()
 		case _, ok := <-s.outputDone:
 			if !ok {
@@ -0,0 +1,210 @@
+package hail
+
+import (
+	"github.com/lesismal/nbio/nbhttp/websocket"
+	"sync"
+	"time"
+)
+
+// SlowConsumerPolicy 輸出緩衝區已滿時的處理方式 (what to do when the output buffer of a session is full)
+// It applies the same way to direct writes, broadcasts and pub/sub deliveries.
+// Control frames, such as the close frame, are never dropped: when the buffer is full they
+// take the place of the oldest queued message.
+type SlowConsumerPolicy int
+
+const (
+	// DropNewest 丟棄新訊息 (drop the message being written)
+	DropNewest SlowConsumerPolicy = iota
+	// DropOldest 丟棄最舊的訊息以騰出空間 (drop the oldest queued message to make room)
+	DropOldest
+	// DisconnectSession 關閉跟不上的Session (close the session that cannot keep up)
+	DisconnectSession
+	// BlockWithTimeout 等待最多 SlowConsumerTimeout，逾時則丟棄新訊息 (wait up to SlowConsumerTimeout, then drop the message being written)
+	// Asynchronous publishes never wait, and broadcasts wait in a goroutine of the session so
+	// the other sessions are not held up.
+	BlockWithTimeout
+	// Conflate 丟棄所有排隊中的訊息，只保留最新的 (drop every queued message and keep only the newest one)
+	Conflate
+)
+
+// backlog 廣播給 BlockWithTimeout Session 但還放不進 output 的訊息，依序由一個 goroutine 等待放入
+// (broadcasts to a BlockWithTimeout session that did not fit in output yet, queued in order by one goroutine)
+type backlog struct {
+	mutex    sync.Mutex
+	messages []*box
+	running  bool
+}
+
+// isControl 控制訊框 (a control frame, such as the close frame)
+func isControl(message *box) bool {
+	return message.t != websocket.TextMessage && message.t != websocket.BinaryMessage
+}
+
+// offer 不等待地放入 output (put message on output without waiting)
+func (s *Session) offer(message *box) bool {
+	select {
+	case s.output <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// tryQueue 不等待地放入 output，output 已滿時回傳 false (queue message without waiting, false when output is full)
+func (s *Session) tryQueue(message *box) bool {
+	s.queueMutex.Lock()
+	defer s.queueMutex.Unlock()
+
+	return s.offer(message)
+}
+
+// enqueue 依 SlowConsumerPolicy 將訊息放入 output (queue message on output according to the SlowConsumerPolicy)
+func (s *Session) enqueue(message *box, wait time.Duration) error {
+	policy := s.hail.Option.SlowConsumerPolicy
+
+	s.queueMutex.Lock()
+	// 在 Close 移走 output 之後才放入的訊息改交給 parking (a message queued after Close carried output over goes to the parking instead)
+	if p := s.parking(); p != nil && s.closed() {
+		s.queueMutex.Unlock()
+		return p.write(s, message)
+	}
+
+	ok := s.offer(message)
+	if !ok && (isControl(message) || policy == DropOldest || policy == Conflate) {
+		ok = s.evict(policy == Conflate && !isControl(message)) && s.offer(message)
+	}
+	s.queueMutex.Unlock()
+
+	if ok {
+		return nil
+	}
+
+	switch policy {
+	case DisconnectSession:
+		s.setDisconnect(DisconnectBufferOverflow, nil, ErrSessionMessageBufferIsFull)
+		// 呼叫端可能持有 hub 的鎖，改在另一個 goroutine 關閉 (the caller may hold the hub lock, close from another goroutine)
+		go s.Close()
+
+	case BlockWithTimeout:
+		if wait > 0 && s.wait(message, wait) {
+			return nil
+		}
+	}
+
+	s.dropped(message, false)
+	return ErrSessionMessageBufferIsFull
+}
+
+// wait 等待 output 有空位，最多 wait (wait at most wait for room in output)
+func (s *Session) wait(message *box, wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		if s.tryQueue(message) {
+			return true
+		}
+
+		select {
+		case <-s.space:
+		case <-timer.C:
+			return false
+		case <-s.outputDone:
+			return false
+		}
+	}
+}
+
+// evict 丟棄排隊中最舊的資料訊息，all 時丟棄全部，控制訊框保留原順序；必須持有 queueMutex
+// (drop the oldest queued data message, or all of them, keeping control frames in order; queueMutex must be held)
+func (s *Session) evict(all bool) bool {
+	var kept []*box
+	evicted := false
+
+drain:
+	for {
+		select {
+		case old := <-s.output:
+			if isControl(old) || (evicted && !all) {
+				kept = append(kept, old)
+				continue
+			}
+
+			s.dropped(old, true)
+			evicted = true
+
+			// 最前面就是資料訊息，不需要重排 (the head was a data message, nothing to reorder)
+			if !all && len(kept) == 0 {
+				break drain
+			}
+		default:
+			break drain
+		}
+	}
+
+	// 持有 queueMutex，沒有其他寫入者，放回一定有空位 (no other writer holds queueMutex, so there is room to put them back)
+	for _, old := range kept {
+		s.output <- old
+	}
+
+	return evicted
+}
+
+// deliver 由 hub 呼叫，BlockWithTimeout 的等待交給 Session 自己的 goroutine，hub 不會被卡住
+// (called by the hub, the wait of BlockWithTimeout happens in a goroutine of the session so the hub never blocks)
+func (s *Session) deliver(message *box) {
+	if s.hail.Option.SlowConsumerPolicy != BlockWithTimeout || s.closed() {
+		s.writeMessage(message)
+		return
+	}
+
+	b := s.backlog
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// 已有排隊中的訊息時必須排在後面 (queue behind the messages already waiting)
+	if !b.running && s.tryQueue(message) {
+		return
+	}
+
+	if len(b.messages) >= s.hail.Option.ChannelBufferSize {
+		s.dropped(message, false)
+		return
+	}
+
+	b.messages = append(b.messages, message)
+	if !b.running {
+		b.running = true
+		go s.drainBacklog()
+	}
+}
+
+// drainBacklog 依序把 backlog 的訊息放入 output (move the messages of the backlog to output, in order)
+func (s *Session) drainBacklog() {
+	b := s.backlog
+
+	for {
+		b.mutex.Lock()
+		if len(b.messages) == 0 {
+			b.running = false
+			b.mutex.Unlock()
+			return
+		}
+		message := b.messages[0]
+		b.messages = b.messages[1:]
+		b.mutex.Unlock()
+
+		s.writeMessage(message)
+	}
+}
+
+// dropped 回報被丟棄的訊息，evicted 表示是為新訊息騰出空間而丟棄的舊訊息，不視為寫入錯誤
+// (report a dropped message, evicted marks an old message dropped to make room, which is not a write error)
+func (s *Session) dropped(message *box, evicted bool) {
+	s.hail.observers.messageDropped(s)
+	s.logger.Warn("output buffer full, message dropped", "policy", s.hail.Option.SlowConsumerPolicy, "size", len(message.msg), "evicted", evicted)
+	if !evicted {
+		s.hail.errorHandler(s, ErrSessionMessageBufferIsFull)
+	}
+	s.hail.droppedHandler(s, message.msg)
+}
@@ -0,0 +1,193 @@
+package hail_test
+
+import (
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/hailtest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stall 讓 "stall" 訊息卡在 outbound middleware，模擬跟不上的客戶端，回傳開始卡住的通知與放行函式
+// (hold "stall" messages in an outbound middleware, like a client that cannot keep up; returns when it stalls and a release func)
+func stall(t *testing.T, h *hail.Hail) (<-chan struct{}, func()) {
+	stalled := make(chan struct{}, 1)
+	gate := make(chan struct{})
+	var once sync.Once
+	release := func() { once.Do(func() { close(gate) }) }
+	t.Cleanup(release)
+
+	h.UseOutbound(func(next hail.Handler) hail.Handler {
+		return func(s *hail.Session, mt hail.MessageType, msg []byte) error {
+			if string(msg) == "stall" {
+				stalled <- struct{}{}
+				<-gate
+			}
+			return next(s, mt, msg)
+		}
+	})
+
+	return stalled, release
+}
+
+func connectID(h *hail.Hail) <-chan string {
+	ids := make(chan string, 2)
+	h.HandleConnect(func(s *hail.Session) {
+		ids <- s.GetHashID()
+	})
+
+	return ids
+}
+
+func TestBlockWithTimeoutDoesNotStallBroadcast(t *testing.T) {
+	srv := newServer(t, &hail.Option{
+		ChannelBufferSize:   2,
+		SlowConsumerPolicy:  hail.BlockWithTimeout,
+		SlowConsumerTimeout: 5 * time.Second,
+	})
+	h := srv.Hail
+	ids := connectID(h)
+	stalled, release := stall(t, h)
+
+	slow := srv.Dial(t)
+	slowID := <-ids
+	fast := srv.Dial(t)
+	<-ids
+
+	h.SendTo(slowID, []byte("stall"))
+	<-stalled
+
+	start := time.Now()
+	for _, m := range []string{"a", "b", "c", "d"} {
+		h.Broadcast([]byte(m))
+	}
+	for _, m := range []string{"a", "b", "c", "d"} {
+		fast.ExpectWithin(m, time.Second)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("broadcast to the fast client took %s", d)
+	}
+
+	release()
+	for _, m := range []string{"stall", "a", "b", "c", "d"} {
+		slow.Expect(m)
+	}
+}
+
+func TestDropOldestKeepsCloseFrame(t *testing.T) {
+	srv := newServer(t, &hail.Option{
+		ChannelBufferSize:    2,
+		SlowConsumerPolicy:   hail.DropOldest,
+		CloseSessionWaitTime: hailtest.DefaultTimeout,
+	})
+	h := srv.Hail
+	ids := connectID(h)
+	stalled, release := stall(t, h)
+
+	var mutex sync.Mutex
+	var dropped []string
+	var errs []error
+	h.HandleDropped(func(s *hail.Session, msg []byte) {
+		mutex.Lock()
+		dropped = append(dropped, string(msg))
+		mutex.Unlock()
+	})
+	h.HandleError(func(s *hail.Session, err error) {
+		mutex.Lock()
+		errs = append(errs, err)
+		mutex.Unlock()
+	})
+
+	c := srv.Dial(t)
+	id := <-ids
+	s, _ := h.Session(id)
+
+	s.Write([]byte("stall"))
+	<-stalled
+
+	s.Write([]byte("1"))
+	s.Write([]byte("2"))
+	s.CloseWithReason(hail.ClosePolicyViolation, "bye")
+	s.Write([]byte("3"))
+
+	release()
+	c.Expect("stall")
+	c.ExpectClose(hail.ClosePolicyViolation)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(dropped) != 2 || dropped[0] != "1" || dropped[1] != "2" {
+		t.Errorf("dropped %q, want [1 2]", dropped)
+	}
+	for _, err := range errs {
+		if err == hail.ErrSessionMessageBufferIsFull {
+			t.Errorf("evicting an old message reported %v", err)
+		}
+	}
+}
+
+func TestDisconnectSessionOnFullBuffer(t *testing.T) {
+	srv := newServer(t, &hail.Option{
+		ChannelBufferSize:  1,
+		SlowConsumerPolicy: hail.DisconnectSession,
+	})
+	h := srv.Hail
+	ids := connectID(h)
+	stalled, release := stall(t, h)
+
+	disconnected := make(chan hail.DisconnectInfo, 1)
+	h.HandleDisconnectInfo(func(s *hail.Session, info hail.DisconnectInfo) {
+		disconnected <- info
+	})
+
+	c := srv.Dial(t)
+	s, _ := h.Session(<-ids)
+
+	s.Write([]byte("stall"))
+	<-stalled
+
+	if err := s.Write([]byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write([]byte("2")); err != hail.ErrSessionMessageBufferIsFull {
+		t.Fatalf("got %v, want ErrSessionMessageBufferIsFull", err)
+	}
+	release()
+
+	select {
+	case info := <-disconnected:
+		if info.Cause != hail.DisconnectBufferOverflow {
+			t.Fatalf("got cause %s, want buffer_overflow", info.Cause)
+		}
+	case <-time.After(hailtest.DefaultTimeout):
+		t.Fatal("session not disconnected")
+	}
+	c.ExpectClose(0)
+}
+
+func TestConflateKeepsNewest(t *testing.T) {
+	srv := newServer(t, &hail.Option{
+		ChannelBufferSize:  3,
+		SlowConsumerPolicy: hail.Conflate,
+	})
+	h := srv.Hail
+	ids := connectID(h)
+	stalled, release := stall(t, h)
+
+	c := srv.Dial(t)
+	s, _ := h.Session(<-ids)
+
+	s.Write([]byte("stall"))
+	<-stalled
+
+	for _, msg := range []string{"1", "2", "3", "4"} {
+		if err := s.Write([]byte(msg)); err != nil {
+			t.Fatalf("writing %s: %v", msg, err)
+		}
+	}
+
+	release()
+	c.Expect("stall")
+	c.Expect("4")
+	c.ExpectNothing(50 * time.Millisecond)
+}
@@ -0,0 +1,113 @@
+package hail
+
+import "strings"
+
+const (
+	topicSeparator      = "/"
+	singleLevelWildcard = "+"
+	multiLevelWildcard  = "#"
+)
+
+// topicNode 訂閱的字典樹，每一層對應 topic 的一段 (subscription trie, one level per topic segment)
+type topicNode struct {
+	children    map[string]*topicNode
+	subscribers map[*Session]bool
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children:    make(map[string]*topicNode),
+		subscribers: make(map[*Session]bool),
+	}
+}
+
+// splitTopic 將 topic 依 "/" 切成各層 (split a topic into its levels)
+func splitTopic(topic string) []string {
+	return strings.Split(topic, topicSeparator)
+}
+
+// validTopicFilter 檢查萬用字元的位置 (check where the wildcards are placed)
+// "+" must fill a whole level, "#" must fill the last level.
+func validTopicFilter(filter string) bool {
+	levels := splitTopic(filter)
+	for i, level := range levels {
+		if strings.Contains(level, multiLevelWildcard) && (level != multiLevelWildcard || i != len(levels)-1) {
+			return false
+		}
+
+		if strings.Contains(level, singleLevelWildcard) && level != singleLevelWildcard {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validTopicNames 發布的 topic 不能含萬用字元 (the topics of a publish cannot contain wildcards)
+func validTopicNames(topics []string) bool {
+	for _, topic := range topics {
+		if strings.ContainsAny(topic, singleLevelWildcard+multiLevelWildcard) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (n *topicNode) insert(levels []string, s *Session) {
+	node := n
+	for _, level := range levels {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTopicNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+
+	node.subscribers[s] = true
+}
+
+// remove 移除訂閱，並清掉空的節點 (remove a subscription and prune the empty nodes)
+func (n *topicNode) remove(levels []string, s *Session) {
+	if len(levels) == 0 {
+		delete(n.subscribers, s)
+		return
+	}
+
+	child, ok := n.children[levels[0]]
+	if !ok {
+		return
+	}
+
+	child.remove(levels[1:], s)
+
+	if len(child.subscribers) == 0 && len(child.children) == 0 {
+		delete(n.children, levels[0])
+	}
+}
+
+// match 找出所有符合 topic 的訂閱者 (collect the subscribers whose filter matches the topic levels)
+func (n *topicNode) match(levels []string, found map[*Session]bool) {
+	// "#" 也符合父層本身，例如 "a/#" 符合 "a" ("#" also matches the parent level, "a/#" matches "a")
+	if child, ok := n.children[multiLevelWildcard]; ok {
+		for s := range child.subscribers {
+			found[s] = true
+		}
+	}
+
+	if len(levels) == 0 {
+		for s := range n.subscribers {
+			found[s] = true
+		}
+		return
+	}
+
+	if child, ok := n.children[levels[0]]; ok {
+		child.match(levels[1:], found)
+	}
+
+	if child, ok := n.children[singleLevelWildcard]; ok {
+		child.match(levels[1:], found)
+	}
+}
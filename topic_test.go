@@ -0,0 +1,38 @@
+package hail_test
+
+import (
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/hailtest"
+	"testing"
+)
+
+func TestWildcardSubscriptions(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+
+	single, multi, exact := srv.Dial(t), srv.Dial(t), srv.Dial(t)
+	subscribe(single, "sensors/+/temp")
+	subscribe(multi, "sensors/#")
+	subscribe(exact, "sensors/kitchen/temp")
+
+	hailtest.ExpectTopic(t, srv.Hail, "sensors/kitchen/temp", "21", []*hailtest.Client{single, multi, exact}, nil)
+	hailtest.ExpectTopic(t, srv.Hail, "sensors/kitchen/humidity", "40", []*hailtest.Client{multi}, []*hailtest.Client{single, exact})
+	hailtest.ExpectTopic(t, srv.Hail, "sensors", "all", []*hailtest.Client{multi}, []*hailtest.Client{single, exact})
+}
+
+func TestPublishRejectsWildcards(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+	h := srv.Hail
+
+	single, multi := srv.Dial(t), srv.Dial(t)
+	subscribe(single, "orders/+")
+	subscribe(multi, "orders/#")
+
+	for _, topic := range []string{"orders/#", "orders/+", "orders/a+"} {
+		if _, err := h.PubTextMsgWithReport([]byte("forged"), hailtest.DefaultTimeout, topic); err != hail.ErrInvalidTopic {
+			t.Fatalf("publishing to %q returned %v, want ErrInvalidTopic", topic, err)
+		}
+	}
+	hailtest.ExpectTopic(t, h, "orders/#", "forged", nil, []*hailtest.Client{single, multi})
+
+	hailtest.ExpectTopic(t, h, "orders/1", "real", []*hailtest.Client{single, multi}, nil)
+}
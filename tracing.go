@@ -0,0 +1,251 @@
+package hail
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// 追蹤屬性的名稱 (names of the span attributes)
+const (
+	AttrSessionID   = "hail.session_id"
+	AttrUserID      = "hail.user_id"
+	AttrTopic       = "hail.topic"
+	AttrEvent       = "hail.event"
+	AttrMessageSize = "hail.message_size"
+	AttrMessageType = "hail.message_type"
+	AttrQueueWait   = "hail.queue_wait"
+	AttrRecipients  = "hail.recipients"
+	AttrError       = "hail.error"
+)
+
+// SpanContext identifies a span. It travels with a message from the hub and pubsub to every session
+// write, between nodes in BackplaneMessage, and to clients in the "trace" field of an Envelope.
+type SpanContext struct {
+	TraceID string `json:"trace_id"`
+	SpanID  string `json:"span_id"`
+}
+
+// IsValid reports whether c identifies a span.
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != "" && c.SpanID != ""
+}
+
+// Span is a unit of work started by a Tracer.
+type Span interface {
+	Context() SpanContext
+	SetAttribute(key string, value interface{})
+	End()
+}
+
+// Tracer starts the spans of the message lifecycle: "hail.broadcast", "hail.publish" and "hail.send"
+// when a message is sent, "hail.write" when it is written to a session, "hail.receive" when a message
+// is read, and "hail.event" when an envelope is routed. An invalid parent starts a new trace.
+type Tracer interface {
+	Start(parent SpanContext, name string, attributes map[string]interface{}) Span
+}
+
+// NopTracer records nothing, it is the default Option.Tracer.
+type NopTracer struct{}
+
+// Start returns a span carrying parent.
+func (NopTracer) Start(parent SpanContext, _ string, _ map[string]interface{}) Span {
+	return nopSpan{parent}
+}
+
+type nopSpan struct {
+	ctx SpanContext
+}
+
+func (s nopSpan) Context() SpanContext {
+	return s.ctx
+}
+
+func (nopSpan) SetAttribute(string, interface{}) {}
+
+func (nopSpan) End() {}
+
+type spanContextKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying sc, Session.Call sends it in the envelope.
+func ContextWithSpan(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanFromContext returns the SpanContext carried by ctx.
+func SpanFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc
+}
+
+// traced 是否設定了 Tracer，避免 NopTracer 時建立屬性 (whether a Tracer is set, so no attributes are built for NopTracer)
+func (h *Hail) traced() bool {
+	_, nop := h.Option.Tracer.(NopTracer)
+	return !nop
+}
+
+// startMessage 為送出的訊息開始 span，並記錄送出的時間 (start the span of an outgoing message and record when it was sent)
+func (h *Hail) startMessage(name string, message *box, attributes map[string]interface{}) Span {
+	message.created = time.Now()
+
+	if !h.traced() {
+		return nopSpan{}
+	}
+
+	if attributes == nil {
+		attributes = make(map[string]interface{})
+	}
+	attributes[AttrMessageSize] = len(message.msg)
+
+	span := h.Option.Tracer.Start(message.trace, name, attributes)
+	message.trace = span.Context()
+
+	return span
+}
+
+// startWrite 寫出帶有 span 的訊息時開始子 span (start a child span when writing a message carrying a span)
+func (s *Session) startWrite(message *box, now time.Time) Span {
+	if !message.trace.IsValid() || !s.hail.traced() {
+		return nopSpan{}
+	}
+
+	attributes := map[string]interface{}{
+		AttrSessionID:   s.hashID,
+		AttrMessageSize: len(message.msg),
+	}
+	if !message.created.IsZero() {
+		attributes[AttrQueueWait] = now.Sub(message.created)
+	}
+
+	return s.hail.Option.Tracer.Start(message.trace, "hail.write", attributes)
+}
+
+// startReceive 收到訊息時開始新的 trace (start a new trace when a message is read)
+func (s *Session) startReceive(t MessageType, msg []byte) Span {
+	if !s.hail.traced() {
+		return nopSpan{}
+	}
+
+	return s.hail.Option.Tracer.Start(SpanContext{}, "hail.receive", map[string]interface{}{
+		AttrSessionID:   s.hashID,
+		AttrMessageSize: len(msg),
+		AttrMessageType: int(t),
+	})
+}
+
+// setReceived 記下正在處理的訊息的 span，事件以它為父 span (record the span of the message being handled, the parent of its event)
+func (s *Session) setReceived(sc SpanContext) {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	s.received = sc
+}
+
+func (s *Session) receivedSpan() SpanContext {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	return s.received
+}
+
+// RecordedSpan is a span ended on a SpanRecorder.
+type RecordedSpan struct {
+	Name       string
+	Context    SpanContext
+	Parent     SpanContext
+	Attributes map[string]interface{}
+	Start      time.Time
+	End        time.Time
+}
+
+// SpanRecorder is a Tracer keeping the ended spans in memory, for tests.
+type SpanRecorder struct {
+	mutex sync.Mutex
+	spans []RecordedSpan
+}
+
+// NewSpanRecorder creates an empty SpanRecorder.
+func NewSpanRecorder() *SpanRecorder {
+	return &SpanRecorder{}
+}
+
+// Start implements Tracer.
+func (r *SpanRecorder) Start(parent SpanContext, name string, attributes map[string]interface{}) Span {
+	sc := SpanContext{TraceID: parent.TraceID, SpanID: randomID(8)}
+	if !parent.IsValid() {
+		sc.TraceID = randomID(16)
+	}
+
+	copied := make(map[string]interface{}, len(attributes))
+	for k, v := range attributes {
+		copied[k] = v
+	}
+
+	return &recordedSpan{recorder: r, span: RecordedSpan{
+		Name:       name,
+		Context:    sc,
+		Parent:     parent,
+		Attributes: copied,
+		Start:      time.Now(),
+	}}
+}
+
+// Spans returns the ended spans, in the order they ended.
+func (r *SpanRecorder) Spans() []RecordedSpan {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]RecordedSpan(nil), r.spans...)
+}
+
+// Reset forgets the recorded spans.
+func (r *SpanRecorder) Reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.spans = nil
+}
+
+type recordedSpan struct {
+	recorder *SpanRecorder
+	mutex    sync.Mutex
+	span     RecordedSpan
+	ended    bool
+}
+
+func (s *recordedSpan) Context() SpanContext {
+	return s.span.Context
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.ended {
+		s.span.Attributes[key] = value
+	}
+}
+
+func (s *recordedSpan) End() {
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.span.End = time.Now()
+	span := s.span
+	s.mutex.Unlock()
+
+	s.recorder.mutex.Lock()
+	s.recorder.spans = append(s.recorder.spans, span)
+	s.recorder.mutex.Unlock()
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,44 @@
+package hail_test
+
+import (
+	"encoding/json"
+	"github.com/lishank0119/hail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventSpanIsChildOfReceive(t *testing.T) {
+	recorder := hail.NewSpanRecorder()
+	srv := newServer(t, &hail.Option{Tracer: recorder, AckEvents: true})
+	srv.Hail.On("ping", func(s *hail.Session, data json.RawMessage) error {
+		return nil
+	})
+
+	c := srv.Dial(t)
+	c.Send(`{"event":"ping","id":1}`)
+	c.Expect(`{"event":"ping","id":1,"reply":true}`)
+
+	spans := make(map[string]hail.RecordedSpan)
+	for deadline := time.Now().Add(time.Second); len(spans) < 2 && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		for _, span := range recorder.Spans() {
+			spans[span.Name] = span
+		}
+	}
+
+	receive, event := spans["hail.receive"], spans["hail.event"]
+	if !receive.Context.IsValid() || event.Parent != receive.Context {
+		t.Fatalf("hail.event parent is %+v, want hail.receive %+v", event.Parent, receive.Context)
+	}
+}
+
+func TestBackplaneMessageOmitsEmptyTrace(t *testing.T) {
+	data, err := json.Marshal(&hail.BackplaneMessage{Kind: hail.BackplaneBroadcast})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(data), "trace") {
+		t.Fatalf("got %s, want no trace", data)
+	}
+}
@@ -0,0 +1,124 @@
+package hail_test
+
+import (
+	"github.com/lishank0119/hail"
+	"github.com/lishank0119/hail/hailtest"
+	"testing"
+	"time"
+)
+
+func TestSendToUserFansOut(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+	h := srv.Hail
+	h.HandleConnect(func(s *hail.Session) {
+		s.BindUser(s.Request.URL.Query().Get("user"))
+	})
+
+	a1 := srv.DialWith(t, "user=alice", nil)
+	a2 := srv.DialWith(t, "user=alice", nil)
+	b := srv.DialWith(t, "user=bob", nil)
+
+	if err := h.SendToUser("alice", []byte("hi alice")); err != nil {
+		t.Fatal(err)
+	}
+	a1.Expect("hi alice")
+	a2.Expect("hi alice")
+	b.ExpectNothing(50 * time.Millisecond)
+
+	if err := h.SendToUser("carol", []byte("nobody")); err != hail.ErrSessionNotFound {
+		t.Fatalf("got %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestBindUserFromBroadcastFilter(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+	h := srv.Hail
+
+	a := srv.Dial(t)
+	b := srv.Dial(t)
+
+	h.BroadcastFilter([]byte("rebound"), func(s *hail.Session) bool {
+		s.BindUser("dave")
+		return true
+	})
+	hailtest.ExpectBroadcast(t, "rebound", a, b)
+
+	if n := len(h.UserSessions("dave")); n != 2 {
+		t.Fatalf("got %d sessions for dave, want 2", n)
+	}
+}
+
+func TestBindUserAnnouncesFirstBindOnce(t *testing.T) {
+	srv := newServer(t, &hail.Option{})
+	h := srv.Hail
+	ids := connectID(h)
+
+	presence := make(chan hail.PresenceEvent, 8)
+	h.HandlePresence(func(e hail.PresenceEvent) {
+		presence <- e
+	})
+
+	srv.Dial(t)
+	s, _ := h.Session(<-ids)
+	if e := <-presence; e.UserID != "" || !e.Online {
+		t.Fatalf("got %+v, want the unbound session online", e)
+	}
+
+	s.BindUser("alice")
+	s.BindUser("alice")
+	s.BindUser("bob")
+
+	if e := <-presence; e.UserID != "alice" || !e.Online {
+		t.Fatalf("got %+v, want alice online", e)
+	}
+	select {
+	case e := <-presence:
+		t.Fatalf("got unexpected %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCloseUserShrinksOnlineUsers(t *testing.T) {
+	srv := newServer(t, &hail.Option{CloseSessionWaitTime: 50 * time.Millisecond})
+	h := srv.Hail
+	h.HandleConnect(func(s *hail.Session) {
+		s.BindUser(s.Request.URL.Query().Get("user"))
+	})
+
+	disconnected := make(chan string, 2)
+	h.HandleDisconnect(func(s *hail.Session) {
+		disconnected <- s.UserID()
+	})
+
+	a1 := srv.DialWith(t, "user=alice", nil)
+	a2 := srv.DialWith(t, "user=alice", nil)
+	b := srv.DialWith(t, "user=bob", nil)
+	for _, c := range []*hailtest.Client{a1, a2, b} {
+		c.Send("ready")
+		c.Expect("ready")
+	}
+
+	if users := h.OnlineUsers(); len(users) != 2 {
+		t.Fatalf("OnlineUsers() = %v, want alice and bob", users)
+	}
+
+	if err := h.CloseUserWithReason("alice", hail.ClosePolicyViolation, "banned"); err != nil {
+		t.Fatal(err)
+	}
+	a1.ExpectClose(hail.ClosePolicyViolation)
+	a2.ExpectClose(hail.ClosePolicyViolation)
+	<-disconnected
+	<-disconnected
+
+	if users := h.OnlineUsers(); len(users) != 1 || users[0] != "bob" {
+		t.Fatalf("OnlineUsers() = %v, want only bob", users)
+	}
+	b.Send("still here")
+	b.Expect("still here")
+
+	if err := h.CloseUser("bob", []byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	b.Expect("bye")
+	b.ExpectClose(0)
+}